@@ -0,0 +1,326 @@
+package archive
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// OCI镜像层中表示删除的文件: .wh.<name> 删除父层中的<name>, .wh..wh..opq 删除父层中同一目录下的所有文件
+// aufs 使用同样的命名, 另外还有 .wh..wh.plnk 这样以 .wh..wh. 开头的内部目录
+const (
+	WhiteoutPrefix     = ".wh."
+	WhiteoutMetaPrefix = WhiteoutPrefix + WhiteoutPrefix
+	WhiteoutOpaqueDir  = WhiteoutMetaPrefix + ".opq"
+)
+
+// 目录树中whiteout的表示方式, 打包时转换成OCI格式, 解压时从OCI格式转换过来
+type WhiteoutFormat int
+
+const (
+	// 目录树中没有whiteout, 解压时直接删除被whiteout的路径, 得到的是合并之后的rootfs
+	ApplyWhiteoutFormat WhiteoutFormat = iota
+	// .wh. 文件原样保存, 打包时跳过aufs的内部目录
+	AUFSWhiteoutFormat
+	// 删除的文件是 0/0 的字符设备, 被整体替换的目录带有 trusted.overlay.opaque=y
+	OverlayWhiteoutFormat
+)
+
+type Compression int
+
+const (
+	Uncompressed Compression = iota
+	Gzip
+)
+
+type TarOptions struct {
+	WhiteoutFormat WhiteoutFormat
+	// 只用于打包
+	Compression Compression
+	// 只打包这些路径(相对于根目录), 不递归; 为空时打包整个目录树
+	IncludeFiles []string
+	// 以 .wh.<name> 的形式写入的被删除的路径
+	Whiteouts []string
+	// 父层中的内容被整体删除的目录, 写入目录之后紧跟着写入 <dir>/.wh..wh..opq
+	OpaqueDirs []string
+	// 不为nil时用它转换写入的属主, 例如把user namespace容器中宿主机上的id还原成容器内的id
+	Chown func(uid, gid int) (int, int)
+}
+
+const overlayOpaqueXattr = "trusted.overlay.opaque"
+
+const paxXattrPrefix = "SCHILY.xattr."
+
+// 自动识别gzip压缩, 返回解压之后的流
+func DecompressStream(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(br)
+	}
+	return io.NopCloser(br), nil
+}
+
+// 判断文件是否是gzip压缩的
+func IsGzip(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	magic := make([]byte, 2)
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return false, nil
+	}
+	return magic[0] == 0x1f && magic[1] == 0x8b, nil
+}
+
+// 把root下的目录树按OCI层的格式打包写入w
+// 保留数字属主, 权限, xattr, 硬链接和设备文件, 目录树中的whiteout按 WhiteoutFormat 转换成 .wh. 文件
+func Tar(root string, w io.Writer, opts *TarOptions) error {
+	if opts == nil {
+		opts = &TarOptions{}
+	}
+	var gz *gzip.Writer
+	if opts.Compression == Gzip {
+		gz = gzip.NewWriter(w)
+		w = gz
+	}
+	ta := &tarAppender{
+		tw:     tar.NewWriter(w),
+		root:   root,
+		format: opts.WhiteoutFormat,
+		links:  map[[2]uint64]string{},
+		opaque: map[string]bool{},
+		chown:  opts.Chown,
+	}
+	for _, dir := range opts.OpaqueDirs {
+		ta.opaque[cleanName(dir)] = true
+	}
+
+	if opts.IncludeFiles == nil {
+		err := filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root, file)
+			if err != nil {
+				return err
+			}
+			if rel == "." {
+				return nil
+			}
+			skip, err := ta.add(rel, info)
+			if skip && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		for _, file := range opts.IncludeFiles {
+			rel := cleanName(file)
+			if rel == "" {
+				continue
+			}
+			info, err := os.Lstat(filepath.Join(root, rel))
+			if err != nil {
+				return err
+			}
+			if _, err := ta.add(rel, info); err != nil {
+				return err
+			}
+		}
+	}
+	for _, deleted := range opts.Whiteouts {
+		rel := cleanName(deleted)
+		if rel == "" {
+			continue
+		}
+		dir, base := path.Split(rel)
+		if err := ta.writeWhiteout(path.Join(dir, WhiteoutPrefix+base)); err != nil {
+			return err
+		}
+	}
+
+	if err := ta.tw.Close(); err != nil {
+		return err
+	}
+	if gz != nil {
+		return gz.Close()
+	}
+	return nil
+}
+
+type tarAppender struct {
+	tw     *tar.Writer
+	root   string
+	format WhiteoutFormat
+	// 已经写入的多链接文件, (dev, ino) 到第一次写入时的名字, 之后的名字写成硬链接
+	links map[[2]uint64]string
+	// OpaqueDirs 中的目录
+	opaque map[string]bool
+	chown  func(uid, gid int) (int, int)
+}
+
+// 写入一个路径, 返回值表示这个路径(以及目录下的内容)被跳过
+func (ta *tarAppender) add(rel string, info os.FileInfo) (bool, error) {
+	rel = filepath.ToSlash(rel)
+	file := filepath.Join(ta.root, rel)
+	if ta.format == AUFSWhiteoutFormat && strings.HasPrefix(path.Base(rel), WhiteoutMetaPrefix) && path.Base(rel) != WhiteoutOpaqueDir {
+		return true, nil
+	}
+	if ta.format == OverlayWhiteoutFormat && isOverlayWhiteout(info) {
+		dir, base := path.Split(rel)
+		return true, ta.writeWhiteout(path.Join(dir, WhiteoutPrefix+base))
+	}
+
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(file); err != nil {
+			return false, err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return false, fmt.Errorf("%s: %v", rel, err)
+	}
+	hdr.Name = rel
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	hdr.Format = tar.FormatPAX
+	// 只保存数字属主, 宿主机上的用户名对镜像没有意义
+	hdr.Uname, hdr.Gname = "", ""
+	hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+	hdr.ModTime = hdr.ModTime.Truncate(time.Second)
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false, fmt.Errorf("Stat %s error", rel)
+	}
+	hdr.Uid, hdr.Gid = int(stat.Uid), int(stat.Gid)
+	if ta.chown != nil {
+		hdr.Uid, hdr.Gid = ta.chown(hdr.Uid, hdr.Gid)
+	}
+
+	if hdr.Typeflag == tar.TypeReg && stat.Nlink > 1 {
+		key := [2]uint64{uint64(stat.Dev), stat.Ino}
+		if first, ok := ta.links[key]; ok {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = first
+			hdr.Size = 0
+		} else {
+			ta.links[key] = rel
+		}
+	}
+
+	xattrs, err := listXattrs(file)
+	if err != nil {
+		return false, fmt.Errorf("Read xattrs of %s error %v", rel, err)
+	}
+	opaque := info.IsDir() && ta.opaque[rel]
+	for name, value := range xattrs {
+		// overlay的内部属性不属于文件本身
+		if strings.HasPrefix(name, "trusted.overlay.") {
+			if ta.format == OverlayWhiteoutFormat && name == overlayOpaqueXattr && value == "y" {
+				opaque = info.IsDir()
+			}
+			continue
+		}
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = map[string]string{}
+		}
+		hdr.PAXRecords[paxXattrPrefix+name] = value
+	}
+
+	if err := ta.tw.WriteHeader(hdr); err != nil {
+		return false, fmt.Errorf("Write header of %s error %v", rel, err)
+	}
+	if hdr.Typeflag == tar.TypeReg && hdr.Size > 0 {
+		f, err := os.Open(file)
+		if err != nil {
+			return false, err
+		}
+		_, err = io.Copy(ta.tw, f)
+		f.Close()
+		if err != nil {
+			return false, fmt.Errorf("Write %s error %v", rel, err)
+		}
+	}
+	if opaque {
+		return false, ta.writeWhiteout(path.Join(rel, WhiteoutOpaqueDir))
+	}
+	return false, nil
+}
+
+func (ta *tarAppender) writeWhiteout(name string) error {
+	return ta.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Format:   tar.FormatPAX,
+	})
+}
+
+// overlay中删除的文件是一个 0/0 的字符设备
+func isOverlayWhiteout(info os.FileInfo) bool {
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && stat.Rdev == 0
+}
+
+func listXattrs(file string) (map[string]string, error) {
+	size, err := unix.Llistxattr(file, nil)
+	if err != nil {
+		if err == unix.ENOTSUP || err == unix.EOPNOTSUPP {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if size == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(file, buf); err != nil {
+		return nil, err
+	}
+	xattrs := map[string]string{}
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		if name == "" {
+			continue
+		}
+		value := make([]byte, 256)
+		for {
+			n, err := unix.Lgetxattr(file, name, value)
+			if err == unix.ERANGE {
+				value = make([]byte, len(value)*4)
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			xattrs[name] = string(value[:n])
+			break
+		}
+	}
+	return xattrs, nil
+}
+
+// 把路径规范成不带开头 / 的相对路径, 根目录返回空字符串
+func cleanName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(name)), "/")
+}
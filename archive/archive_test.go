@@ -0,0 +1,190 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestTarRoundTrip(t *testing.T) {
+	src, err := ioutil.TempDir("", "paddle-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	os.MkdirAll(filepath.Join(src, "etc/opaque"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "etc/hosts"), []byte("127.0.0.1"), 0600)
+	os.Link(filepath.Join(src, "etc/hosts"), filepath.Join(src, "etc/hosts.link"))
+	os.Symlink("/etc/hosts", filepath.Join(src, "hosts"))
+	os.Chown(filepath.Join(src, "etc/hosts"), 1000, 1000)
+	// 上层中被删除的文件和被整体替换的目录
+	if err := unix.Mknod(filepath.Join(src, "etc/gone"), unix.S_IFCHR, 0); err != nil {
+		t.Skipf("mknod whiteout: %v", err)
+	}
+	if err := unix.Setxattr(filepath.Join(src, "etc/opaque"), overlayOpaqueXattr, []byte("y"), 0); err != nil {
+		t.Skipf("set trusted xattr: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := Tar(src, &buf, &TarOptions{WhiteoutFormat: OverlayWhiteoutFormat, Compression: Gzip}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 解压成overlay格式时还原whiteout
+	dest, err := ioutil.TempDir("", "paddle-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dest)
+	if err := Untar(bytes.NewReader(buf.Bytes()), dest, &TarOptions{WhiteoutFormat: OverlayWhiteoutFormat}); err != nil {
+		t.Fatal(err)
+	}
+	var st syscall.Stat_t
+	if err := syscall.Lstat(filepath.Join(dest, "etc/hosts"), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Uid != 1000 || st.Gid != 1000 || st.Mode&0777 != 0600 || st.Nlink != 2 {
+		t.Fatalf("etc/hosts: uid %d gid %d mode %o nlink %d", st.Uid, st.Gid, st.Mode&0777, st.Nlink)
+	}
+	if link, _ := os.Readlink(filepath.Join(dest, "hosts")); link != "/etc/hosts" {
+		t.Fatalf("hosts links to %q", link)
+	}
+	if info, err := os.Lstat(filepath.Join(dest, "etc/gone")); err != nil || !isOverlayWhiteout(info) {
+		t.Fatalf("etc/gone is not a whiteout: %v", err)
+	}
+	value := make([]byte, 1)
+	if _, err := unix.Getxattr(filepath.Join(dest, "etc/opaque"), overlayOpaqueXattr, value); err != nil || value[0] != 'y' {
+		t.Fatalf("etc/opaque is not opaque: %v", err)
+	}
+
+	// 直接应用whiteout时删除父层中的文件
+	ioutil.WriteFile(filepath.Join(dest, "etc/opaque/old"), nil, 0644)
+	if err := Untar(bytes.NewReader(buf.Bytes()), dest, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, deleted := range []string{"etc/gone", "etc/opaque/old"} {
+		if _, err := os.Lstat(filepath.Join(dest, deleted)); !os.IsNotExist(err) {
+			t.Fatalf("%s is not deleted", deleted)
+		}
+	}
+}
+
+func TestUntarBreakout(t *testing.T) {
+	testCases := []struct {
+		name    string
+		headers []*tar.Header
+		escape  bool
+	}{
+		{"dotdot", []*tar.Header{{Name: "../escape", Typeflag: tar.TypeReg, Mode: 0644}}, true},
+		{"hardlink", []*tar.Header{{Name: "escape", Typeflag: tar.TypeLink, Linkname: "../../etc/passwd"}}, true},
+		{"symlink", []*tar.Header{
+			{Name: "root", Typeflag: tar.TypeSymlink, Linkname: "/"},
+			{Name: "up", Typeflag: tar.TypeSymlink, Linkname: "../../.."},
+			{Name: "root/escape", Typeflag: tar.TypeReg, Mode: 0644},
+			{Name: "up/escape2", Typeflag: tar.TypeReg, Mode: 0644},
+		}, false},
+	}
+	for _, tc := range testCases {
+		parent, err := ioutil.TempDir("", "paddle-archive")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(parent)
+		dest := filepath.Join(parent, "a", "b")
+		os.MkdirAll(dest, 0755)
+
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, hdr := range tc.headers {
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		tw.Close()
+		err = Untar(&buf, dest, nil)
+		if tc.escape && err == nil {
+			t.Errorf("%s: expected error", tc.name)
+		}
+		if !tc.escape && err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+		// 无论是否报错, dest之外都不能出现新文件
+		for _, file := range []string{filepath.Join(parent, "escape"), filepath.Join(parent, "a", "escape"), "/escape", "/escape2"} {
+			if _, err := os.Lstat(file); err == nil {
+				t.Errorf("%s: %s written outside of the destination", tc.name, file)
+			}
+		}
+		if !tc.escape {
+			for _, file := range []string{"escape", "escape2"} {
+				if _, err := os.Lstat(filepath.Join(dest, file)); err != nil {
+					t.Errorf("%s: %v", tc.name, err)
+				}
+			}
+		}
+	}
+}
+
+func TestUntarInvalidWhiteout(t *testing.T) {
+	for _, format := range []WhiteoutFormat{ApplyWhiteoutFormat, OverlayWhiteoutFormat} {
+		for _, name := range []string{".wh..", ".wh...", "etc/.wh.."} {
+			parent, err := ioutil.TempDir("", "paddle-archive")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(parent)
+			dest := filepath.Join(parent, "layer", "diff")
+			os.MkdirAll(filepath.Join(dest, "etc"), 0755)
+
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644})
+			tw.Close()
+			if err := Untar(&buf, dest, &TarOptions{WhiteoutFormat: format}); err == nil {
+				t.Errorf("%s: expected error", name)
+			}
+			if _, err := os.Stat(filepath.Join(dest, "etc")); err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+		}
+	}
+}
+
+func TestTarChanges(t *testing.T) {
+	src, err := ioutil.TempDir("", "paddle-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	os.MkdirAll(filepath.Join(src, "dir"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "dir/new"), nil, 0644)
+
+	var buf bytes.Buffer
+	opts := &TarOptions{
+		IncludeFiles: []string{"/dir", "/dir/new"},
+		OpaqueDirs:   []string{"/dir"},
+		Whiteouts:    []string{"/etc/gone"},
+	}
+	if err := Tar(src, &buf, opts); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names = append(names, hdr.Name)
+	}
+	expected := []string{"dir/", "dir/.wh..wh..opq", "dir/new", "etc/.wh.gone"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected %v, got %v", expected, names)
+	}
+}
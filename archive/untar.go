@@ -0,0 +1,312 @@
+package archive
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// 符号链接的最大跟随次数, 和内核的 MAXSYMLINKS 保持一致
+const maxSymlinks = 40
+
+// 把OCI层的tar包解压到dest, 自动识别gzip压缩
+// 保留数字属主, 权限, xattr, 硬链接和设备文件, 已有的文件先删除再创建, 和父层共享的硬链接不会被修改
+// whiteout按 WhiteoutFormat 转换, 路径中的 .. 和符号链接都限制在dest之内, 越界的条目直接返回错误
+func Untar(r io.Reader, dest string, opts *TarOptions) error {
+	if opts == nil {
+		opts = &TarOptions{}
+	}
+	dr, err := DecompressStream(r)
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+
+	// 本层解压出来的路径, 处理 .wh..wh..opq 时不能删除它们
+	unpacked := map[string]bool{}
+	var dirs []*tar.Header
+	dirPaths := map[*tar.Header]string{}
+	tr := tar.NewReader(dr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name, err := checkName(hdr.Name)
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			continue
+		}
+		parent, err := resolveInRoot(dest, path.Dir(name))
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			return err
+		}
+		base := path.Base(name)
+		target := filepath.Join(parent, base)
+
+		if strings.HasPrefix(base, WhiteoutPrefix) {
+			handled, err := unpackWhiteout(opts.WhiteoutFormat, parent, base, unpacked)
+			if err != nil {
+				return fmt.Errorf("%s: %v", hdr.Name, err)
+			}
+			if handled {
+				continue
+			}
+		}
+
+		if err := createEntry(dest, target, hdr, tr); err != nil {
+			return fmt.Errorf("%s: %v", hdr.Name, err)
+		}
+		unpacked[target] = true
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, hdr)
+			dirPaths[hdr] = target
+		}
+	}
+	// 目录中的文件会修改目录的时间, 所以最后再设置
+	for _, hdr := range dirs {
+		if err := setTimes(dirPaths[hdr], hdr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 按格式处理一个 .wh. 开头的条目, 返回false表示按普通文件解压
+func unpackWhiteout(format WhiteoutFormat, parent, base string, unpacked map[string]bool) (bool, error) {
+	if base != WhiteoutOpaqueDir && strings.HasPrefix(base, WhiteoutMetaPrefix) {
+		// aufs的内部文件, 不属于rootfs
+		return true, nil
+	}
+	if format == AUFSWhiteoutFormat {
+		return false, nil
+	}
+	if base == WhiteoutOpaqueDir {
+		if format == OverlayWhiteoutFormat {
+			return true, unix.Setxattr(parent, overlayOpaqueXattr, []byte("y"), 0)
+		}
+		return true, removeOpaque(parent, unpacked)
+	}
+
+	// 和普通条目一样, 被删除的路径是已经在dest中解析过的父目录加上最后一级的名字
+	// .wh.. 和 .wh... 这样的名字会指向父目录本身或者dest之外, 必须拒绝
+	name := strings.TrimPrefix(base, WhiteoutPrefix)
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return false, fmt.Errorf("Invalid whiteout %q", base)
+	}
+	deleted := filepath.Join(parent, name)
+	if format == OverlayWhiteoutFormat {
+		if _, err := os.Lstat(deleted); err == nil {
+			return true, nil
+		}
+		return true, unix.Mknod(deleted, unix.S_IFCHR, 0)
+	}
+	return true, os.RemoveAll(deleted)
+}
+
+// 删除目录中父层的内容, 本层中已经解压的保留
+func removeOpaque(dir string, unpacked map[string]bool) error {
+	return filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if file == dir || unpacked[file] {
+			return nil
+		}
+		if err := os.RemoveAll(file); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+func createEntry(dest, target string, hdr *tar.Header, r io.Reader) error {
+	info := hdr.FileInfo()
+	// 已有的同名文件先删除, 两边都是目录时保留原目录, 只更新属性
+	if fi, err := os.Lstat(target); err == nil {
+		if !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	mode := uint32(hdr.Mode & 07777)
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(target, os.FileMode(mode)); err != nil && !os.IsExist(err) {
+			return err
+		}
+	case tar.TypeReg, tar.TypeRegA:
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, os.FileMode(mode))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, r)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		// 链接内容原样保存, 容器中解析时以rootfs为根, 解压时也不会跟随它写到dest之外
+		if err := os.Symlink(hdr.Linkname, target); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		linkName, err := checkName(hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		linkParent, err := resolveInRoot(dest, path.Dir(linkName))
+		if err != nil {
+			return err
+		}
+		// 硬链接到符号链接时链接的是符号链接本身, 不跟随最后一级
+		if err := os.Link(filepath.Join(linkParent, path.Base(linkName)), target); err != nil {
+			return err
+		}
+		// 硬链接和原文件是同一个inode, 属性已经设置过
+		return nil
+	case tar.TypeChar:
+		if err := unix.Mknod(target, unix.S_IFCHR|mode, int(unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor)))); err != nil {
+			return err
+		}
+	case tar.TypeBlock:
+		if err := unix.Mknod(target, unix.S_IFBLK|mode, int(unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor)))); err != nil {
+			return err
+		}
+	case tar.TypeFifo:
+		if err := unix.Mkfifo(target, mode); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("Unsupported tar entry type %q", hdr.Typeflag)
+	}
+
+	if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+		return err
+	}
+	for key, value := range hdr.PAXRecords {
+		if !strings.HasPrefix(key, paxXattrPrefix) {
+			continue
+		}
+		name := strings.TrimPrefix(key, paxXattrPrefix)
+		if err := unix.Lsetxattr(target, name, []byte(value), 0); err != nil {
+			if err == unix.ENOTSUP || err == unix.EOPNOTSUPP {
+				continue
+			}
+			return fmt.Errorf("Set xattr %s error %v", name, err)
+		}
+	}
+	// chown 会清掉 setuid/setgid 位, 所以权限在属主之后设置
+	if hdr.Typeflag != tar.TypeSymlink {
+		if err := os.Chmod(target, info.Mode()); err != nil {
+			return err
+		}
+	}
+	if hdr.Typeflag == tar.TypeDir {
+		return nil
+	}
+	return setTimes(target, hdr)
+}
+
+func setTimes(target string, hdr *tar.Header) error {
+	atime := hdr.AccessTime
+	if atime.IsZero() {
+		atime = hdr.ModTime
+	}
+	times := []unix.Timespec{timespec(atime), timespec(hdr.ModTime)}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, target, times, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+func timespec(t time.Time) unix.Timespec {
+	ts, _ := unix.TimeToTimespec(t)
+	return ts
+}
+
+// 检查tar包中的路径, 返回不带开头 / 的相对路径
+// 绝对路径按相对于dest处理, 通过 .. 跳出dest的路径返回错误
+func checkName(name string) (string, error) {
+	clean := path.Clean(strings.TrimLeft(filepath.ToSlash(name), "/"))
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("Invalid path %q outside of the destination", name)
+	}
+	if clean == "." {
+		return "", nil
+	}
+	return clean, nil
+}
+
+// 在root中解析相对路径rel, 路径上的符号链接都以root为根目录解析, 就像在chroot中一样
+// 绝对链接和多余的 .. 都停留在root之内, 不存在的部分按普通目录处理
+func resolveInRoot(root, rel string) (string, error) {
+	current := ""
+	remaining := rel
+	links := 0
+	for remaining != "" {
+		var part string
+		if i := strings.IndexByte(remaining, '/'); i >= 0 {
+			part, remaining = remaining[:i], remaining[i+1:]
+		} else {
+			part, remaining = remaining, ""
+		}
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			current = strings.TrimPrefix(path.Dir("/"+current), "/")
+			continue
+		}
+		next := path.Join(current, part)
+		info, err := os.Lstat(filepath.Join(root, next))
+		if err != nil {
+			if os.IsNotExist(err) {
+				current = next
+				continue
+			}
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			current = next
+			continue
+		}
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("Too many symlinks in %s", rel)
+		}
+		link, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(link) {
+			current = ""
+		}
+		remaining = link + "/" + remaining
+	}
+	return filepath.Join(root, current), nil
+}
@@ -1,6 +1,8 @@
 package cgroups
 
 import (
+	"fmt"
+
 	"github.com/IsolationWyn/paddle/cgroups/subsystems"
 	"github.com/sirupsen/logrus"
 )
@@ -18,19 +20,22 @@ func NewCgroupManager(path string) *CgroupManager {
 	}
 }
 
-// 将进程pid加入到这个cgroup中
+// 将进程pid加入到这个cgroup中, 任何一个subsystem失败都返回错误, 否则进程会逃出这个subsystem的限制
 func (c *CgroupManager) Apply(pid int) error {
 	for _, subSysIns := range subsystems.SubsystemsIns {
-		subSysIns.Apply(c.Path, pid)
-
+		if err := subSysIns.Apply(c.Path, pid); err != nil {
+			return fmt.Errorf("apply %s cgroup fail %v", subSysIns.Name(), err)
+		}
 	}
 	return nil
 }
 
-// 设置cgroup资源限制
+// 设置cgroup资源限制, 同时在每个subsystem中创建这个cgroup
 func (c *CgroupManager) Set(res *subsystems.ResourceConfig) error {
 	for _, subSysIns := range subsystems.SubsystemsIns {
-		subSysIns.Set(c.Path, res)
+		if err := subSysIns.Set(c.Path, res); err != nil {
+			return fmt.Errorf("set %s cgroup fail %v", subSysIns.Name(), err)
+		}
 	}
 	return nil
 }
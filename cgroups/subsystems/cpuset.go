@@ -6,6 +6,7 @@ import(
 	"path"
 	"os"
 	"strconv"
+	"strings"
 )
 
 type CpusetSubSystem struct {
@@ -14,6 +15,9 @@ type CpusetSubSystem struct {
 
 func (s *CpusetSubSystem) Set(cgroupPath string, res *ResourceConfig) error {
 	if subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, true); err == nil {
+		if err := inheritCpuset(FindCgroupMountpoint(s.Name()), cgroupPath); err != nil {
+			return err
+		}
 		if res.CpuSet != "" {
 			if err := ioutil.WriteFile(path.Join(subsysCgroupPath, "cpuset.cpus"), []byte(res.CpuSet), 0644); err != nil {
 				return fmt.Errorf("set cgroup cpuset fail %v", err)
@@ -25,6 +29,32 @@ func (s *CpusetSubSystem) Set(cgroupPath string, res *ResourceConfig) error {
 	}
 }
 
+// 新建的cpuset cgroup中cpus和mems为空, 这时加入进程会返回ENOSPC
+// 从根节点往下, 为空的cgroup使用父cgroup的值, pod成员的中间节点也一样
+func inheritCpuset(cgroupRoot, cgroupPath string) error {
+	dir := cgroupRoot
+	for _, part := range strings.Split(strings.Trim(cgroupPath, "/"), "/") {
+		parent := dir
+		dir = path.Join(dir, part)
+		for _, file := range []string{"cpuset.cpus", "cpuset.mems"} {
+			content, err := ioutil.ReadFile(path.Join(dir, file))
+			if err != nil {
+				return fmt.Errorf("read %s fail %v", file, err)
+			}
+			if strings.TrimSpace(string(content)) != "" {
+				continue
+			}
+			if content, err = ioutil.ReadFile(path.Join(parent, file)); err != nil {
+				return fmt.Errorf("read %s fail %v", file, err)
+			}
+			if err := ioutil.WriteFile(path.Join(dir, file), content, 0644); err != nil {
+				return fmt.Errorf("set cgroup %s fail %v", file, err)
+			}
+		}
+	}
+	return nil
+}
+
 func (s *CpusetSubSystem) Remove(cgroupPath string) error {
 	if subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, false); err == nil {
 		return os.Remove(subsysCgroupPath)
@@ -0,0 +1,65 @@
+package subsystems
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+)
+
+type DevicesSubSystem struct {
+}
+
+// 先拒绝所有设备, 再逐条写入允许访问的设备规则
+// 没有规则时只创建cgroup, 继承父cgroup的规则, 例如pod的cgroup
+func (s *DevicesSubSystem) Set(cgroupPath string, res *ResourceConfig) error {
+	if FindCgroupMountpoint(s.Name()) == "" {
+		return nil
+	}
+	if subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, true); err == nil {
+		if len(res.DeviceRules) == 0 {
+			return nil
+		}
+		if err := ioutil.WriteFile(path.Join(subsysCgroupPath, "devices.deny"), []byte("a"), 0644); err != nil {
+			return fmt.Errorf("set cgroup devices deny fail %v", err)
+		}
+		for _, rule := range res.DeviceRules {
+			if err := ioutil.WriteFile(path.Join(subsysCgroupPath, "devices.allow"), []byte(rule), 0644); err != nil {
+				return fmt.Errorf("set cgroup devices allow %s fail %v", rule, err)
+			}
+		}
+		return nil
+	} else {
+		return err
+	}
+}
+
+func (s *DevicesSubSystem) Remove(cgroupPath string) error {
+	if FindCgroupMountpoint(s.Name()) == "" {
+		return nil
+	}
+	if subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, false); err == nil {
+		return os.Remove(subsysCgroupPath)
+	} else {
+		return err
+	}
+}
+
+func (s *DevicesSubSystem) Apply(cgroupPath string, pid int) error {
+	if FindCgroupMountpoint(s.Name()) == "" {
+		return nil
+	}
+	if subsysCgroupPath, err := GetCgroupPath(s.Name(), cgroupPath, false); err == nil {
+		if err := ioutil.WriteFile(path.Join(subsysCgroupPath, "tasks"), []byte(strconv.Itoa(pid)), 0644); err != nil {
+			return fmt.Errorf("set cgroup proc fail %v", err)
+		}
+		return nil
+	} else {
+		return fmt.Errorf("get cgroup %s error: %v", cgroupPath, err)
+	}
+}
+
+func (s *DevicesSubSystem) Name() string {
+	return "devices"
+}
@@ -20,6 +20,12 @@ func (s *MemorySubSystem) Set(cgroupPath string, res *ResourceConfig) error {
 				return fmt.Errorf("set cgroup memory fail %v", err)
 			}
 		}
+		if res.OomKillDisable {
+			// memory.oom_control 写入1之后, cgroup内的进程超出限制时会被挂起而不是被OOM killer杀死
+			if err := ioutil.WriteFile(path.Join(subsysCgroupPath, "memory.oom_control"), []byte("1"), 0644); err != nil {
+				return fmt.Errorf("set cgroup memory oom control fail %v", err)
+			}
+		}
 		return nil
 	} else {
 		return err
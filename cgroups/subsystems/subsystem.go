@@ -1,10 +1,13 @@
 package subsystems
 
-//用于传递资源限制配置的结构体, 包含内存限制, CPU时间片权重, CPU核心数
+//用于传递资源限制配置的结构体, 包含内存限制, CPU时间片权重, CPU核心数, 允许访问的设备
 type ResourceConfig struct {
-	MemoryLimit string
-	CpuShare    string
-	CpuSet      string
+	MemoryLimit    string
+	CpuShare       string
+	CpuSet         string
+	DeviceRules    []string
+	OomKillDisable bool // 超出内存限制时不杀死进程, 而是让它等待内存释放, 只能与MemoryLimit一起使用
+	OomScoreAdj    int  // 不属于cgroup, 由Run写入容器init进程的 /proc/<pid>/oom_score_adj
 }
 
 //Subsystem接口, 每个Subsystem可以实现下面的4个接口
@@ -22,5 +25,6 @@ var (
 		&CpusetSubSystem{},
 		&MemorySubSystem{},
 		&CpuSubSystem{},
+		&DevicesSubSystem{},
 	}
 )
\ No newline at end of file
@@ -1,16 +1,163 @@
 package main
 
 import (
-	log "github.com/sirupsen/logrus"
 	"fmt"
-	"os/exec"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+
+	"github.com/IsolationWyn/paddle/archive"
+	"github.com/IsolationWyn/paddle/container"
+	"github.com/IsolationWyn/paddle/image"
+	"github.com/IsolationWyn/paddle/storage"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+	log "github.com/sirupsen/logrus"
 )
 
-func commitContainer(imageName string) {
-	mntURL := "/root/mnt"
-	imageTar := "/root/" + imageName + ".tar"
-	fmt.Printf("%s", imageTar)
-	if _, err := exec.Command("tar", "-czf", imageTar, "-C", mntURL, ".").CombinedOutput(); err != nil {
-		log.Errorf("Tar folder %s error %v", mntURL, err)
+// 把容器可写层的变化打包成一个新的层, 加在容器所用镜像的所有层之上生成新镜像
+// 新镜像以容器所用镜像的配置为基础, 再依次应用 --change
+// 没有指定容器时沿用原来的用法, 把 /root/mnt 整个打包成只有一个层的镜像
+func commitContainer(containerName, imageName string, changes []string) error {
+	store := image.NewStore(image.DefaultRoot)
+	layerDir, err := ioutil.TempDir("", "paddle-commit")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(layerDir)
+	layerTar := filepath.Join(layerDir, "layer.tar")
+
+	var parent *image.Image
+	config := v1.ImageConfig{}
+	if containerName == "" {
+		if err := writeLayer("/root/mnt", nil, nil, layerTar); err != nil {
+			log.Errorf("Tar folder /root/mnt error %v", err)
+			return err
+		}
+	} else {
+		containerInfo, err := getContainerInfoByName(containerName)
+		if err != nil {
+			return err
+		}
+		if containerInfo.Image == "" {
+			return fmt.Errorf("Container %s has no image", containerName)
+		}
+		// 以容器创建时使用的镜像为父镜像, 镜像名可能已经指向了其它镜像
+		// 没有记录digest的旧容器只能按镜像名查找
+		if containerInfo.ImageDigest != "" {
+			parent, err = store.GetByDigest(containerInfo.Image, digest.Digest(containerInfo.ImageDigest))
+		} else {
+			parent, err = store.Get(containerInfo.Image)
+		}
+		if err != nil {
+			return err
+		}
+		config = parent.Config.Config
+		driver, err := storage.New(containerInfo.StorageDriver)
+		if err != nil {
+			return err
+		}
+		diff, err := driver.Diff(containerName)
+		if err != nil {
+			return fmt.Errorf("Diff container %s error %v", containerName, err)
+		}
+		if err := writeLayer(fmt.Sprintf(container.MntUrl, containerName), diff, containerInfo.IDMappings, layerTar); err != nil {
+			log.Errorf("Write layer of %s error %v", containerName, err)
+			return err
+		}
+	}
+	for _, change := range changes {
+		if err := container.ApplyImageChange(&config, change); err != nil {
+			return err
+		}
+	}
+
+	img, err := store.Commit(imageName, parent, layerTar, config, "paddle commit "+containerName)
+	if err != nil {
+		log.Errorf("Commit image %s error %v", imageName, err)
+		return err
+	}
+	fmt.Println(img.Digest)
+	return nil
+}
+
+// 按OCI层的格式打包rootfs中的变化: 新增和修改的路径从rootfs中读取, 删除的路径写成 .wh.<name>
+// 被删除之后重新创建的目录写成 <dir>/.wh..wh..opq, 父层中目录下原有的内容在解压时被删除
+// changes 为nil时打包整个rootfs
+// 开启了user namespace的容器, rootfs中的属主是宿主机上映射之后的id, 写入层时还原成容器内的id
+// 这样镜像在不开启映射或者使用其它映射运行时属主依然正确
+func writeLayer(rootfs string, changes []storage.Change, mappings *container.IDMappings, layerTar string) error {
+	opts := &archive.TarOptions{}
+	if mappings != nil {
+		opts.Chown = mappings.ToContainer
+	}
+	if changes != nil {
+		opts.IncludeFiles = []string{}
+	}
+	for _, change := range changes {
+		switch change.Kind {
+		case storage.ChangeDelete:
+			opts.Whiteouts = append(opts.Whiteouts, change.Path)
+		case storage.ChangeOpaque:
+			opts.IncludeFiles = append(opts.IncludeFiles, change.Path)
+			opts.OpaqueDirs = append(opts.OpaqueDirs, change.Path)
+		default:
+			opts.IncludeFiles = append(opts.IncludeFiles, change.Path)
+		}
+	}
+	f, err := os.Create(layerTar)
+	if err != nil {
+		return err
+	}
+	if err := archive.Tar(rootfs, f, opts); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// 列出镜像存储中的所有镜像
+func listImages() error {
+	images, err := image.NewStore(image.DefaultRoot).List()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+	fmt.Fprint(w, "NAME\tDIGEST\tLAYERS\tCREATED\n")
+	for _, img := range images {
+		created := ""
+		if img.Config.Created != nil {
+			created = img.Config.Created.Local().Format("2006-01-02 15:04:05")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n",
+			img.Name,
+			img.Digest.Hex()[:12],
+			len(img.Manifest.Layers),
+			created)
+	}
+	if err := w.Flush(); err != nil {
+		log.Errorf("Flush error %v", err)
+	}
+	return nil
+}
+
+// 列出容器可写层相对于镜像的变化
+func diffContainer(containerName string) error {
+	containerInfo, err := getContainerInfoByName(containerName)
+	if err != nil {
+		return err
+	}
+	driver, err := storage.New(containerInfo.StorageDriver)
+	if err != nil {
+		return err
+	}
+	changes, err := driver.Diff(containerName)
+	if err != nil {
+		return fmt.Errorf("Diff container %s error %v", containerName, err)
+	}
+	for _, change := range changes {
+		fmt.Println(change)
 	}
-}
\ No newline at end of file
+	return nil
+}
@@ -0,0 +1,226 @@
+package container
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// 内核中capability的编号, 名字与 include/uapi/linux/capability.h 保持一致
+var capabilityMap = map[string]uint{
+	"CAP_CHOWN":              0,
+	"CAP_DAC_OVERRIDE":       1,
+	"CAP_DAC_READ_SEARCH":    2,
+	"CAP_FOWNER":             3,
+	"CAP_FSETID":             4,
+	"CAP_KILL":               5,
+	"CAP_SETGID":             6,
+	"CAP_SETUID":             7,
+	"CAP_SETPCAP":            8,
+	"CAP_LINUX_IMMUTABLE":    9,
+	"CAP_NET_BIND_SERVICE":   10,
+	"CAP_NET_BROADCAST":      11,
+	"CAP_NET_ADMIN":          12,
+	"CAP_NET_RAW":            13,
+	"CAP_IPC_LOCK":           14,
+	"CAP_IPC_OWNER":          15,
+	"CAP_SYS_MODULE":         16,
+	"CAP_SYS_RAWIO":          17,
+	"CAP_SYS_CHROOT":         18,
+	"CAP_SYS_PTRACE":         19,
+	"CAP_SYS_PACCT":          20,
+	"CAP_SYS_ADMIN":          21,
+	"CAP_SYS_BOOT":           22,
+	"CAP_SYS_NICE":           23,
+	"CAP_SYS_RESOURCE":       24,
+	"CAP_SYS_TIME":           25,
+	"CAP_SYS_TTY_CONFIG":     26,
+	"CAP_MKNOD":              27,
+	"CAP_LEASE":              28,
+	"CAP_AUDIT_WRITE":        29,
+	"CAP_AUDIT_CONTROL":      30,
+	"CAP_SETFCAP":            31,
+	"CAP_MAC_OVERRIDE":       32,
+	"CAP_MAC_ADMIN":          33,
+	"CAP_SYSLOG":             34,
+	"CAP_WAKE_ALARM":         35,
+	"CAP_BLOCK_SUSPEND":      36,
+	"CAP_AUDIT_READ":         37,
+	"CAP_PERFMON":            38,
+	"CAP_BPF":                39,
+	"CAP_CHECKPOINT_RESTORE": 40,
+}
+
+// 与docker一致的默认capability集合, 不包含 CAP_SYS_ADMIN, CAP_NET_ADMIN, CAP_SYS_MODULE 等危险能力
+var DefaultCapabilities = []string{
+	"CAP_CHOWN",
+	"CAP_DAC_OVERRIDE",
+	"CAP_FSETID",
+	"CAP_FOWNER",
+	"CAP_MKNOD",
+	"CAP_NET_RAW",
+	"CAP_SETGID",
+	"CAP_SETUID",
+	"CAP_SETFCAP",
+	"CAP_SETPCAP",
+	"CAP_NET_BIND_SERVICE",
+	"CAP_SYS_CHROOT",
+	"CAP_KILL",
+	"CAP_AUDIT_WRITE",
+}
+
+// 按编号排列的全部capability
+func allCapabilities() []string {
+	caps := make([]string, len(capabilityMap))
+	for name, value := range capabilityMap {
+		caps[value] = name
+	}
+	return caps
+}
+
+// 把 net_admin, NET_ADMIN, CAP_NET_ADMIN 统一成 CAP_NET_ADMIN, ALL 保持不变
+func normalizeCapability(name string) (string, error) {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	if name == "ALL" {
+		return name, nil
+	}
+	if !strings.HasPrefix(name, "CAP_") {
+		name = "CAP_" + name
+	}
+	if _, ok := capabilityMap[name]; !ok {
+		return "", fmt.Errorf("Unknown capability %s", name)
+	}
+	return name, nil
+}
+
+// 在默认集合的基础上根据 --cap-add 和 --cap-drop 计算出容器最终的capability集合
+// privileged 模式下直接返回全部capability, 同时 ALL 可以出现在 add 或 drop 中
+func TweakCapabilities(capAdd, capDrop []string, privileged bool) ([]string, error) {
+	if privileged {
+		return allCapabilities(), nil
+	}
+
+	set := make(map[string]bool)
+	for _, name := range DefaultCapabilities {
+		set[name] = true
+	}
+
+	for _, name := range capDrop {
+		capName, err := normalizeCapability(name)
+		if err != nil {
+			return nil, err
+		}
+		if capName == "ALL" {
+			set = make(map[string]bool)
+			continue
+		}
+		delete(set, capName)
+	}
+	// add 的优先级高于 drop, 这样 --cap-drop ALL --cap-add NET_BIND_SERVICE 可以正常工作
+	for _, name := range capAdd {
+		capName, err := normalizeCapability(name)
+		if err != nil {
+			return nil, err
+		}
+		if capName == "ALL" {
+			for _, c := range allCapabilities() {
+				set[c] = true
+			}
+			continue
+		}
+		set[capName] = true
+	}
+
+	var caps []string
+	for _, name := range allCapabilities() {
+		if set[name] {
+			caps = append(caps, name)
+		}
+	}
+	return caps, nil
+}
+
+// 把capability名字转换成位掩码, 供 paddle exec 通过环境变量传给nsenter
+func CapabilityMask(caps []string) (uint64, error) {
+	var mask uint64
+	for _, name := range caps {
+		capName, err := normalizeCapability(name)
+		if err != nil {
+			return 0, err
+		}
+		mask |= 1 << capabilityMap[capName]
+	}
+	return mask, nil
+}
+
+// 读取当前内核支持的最大capability编号
+func lastCapability() uint {
+	content, err := ioutil.ReadFile("/proc/sys/kernel/cap_last_cap")
+	if err != nil {
+		return uint(len(capabilityMap) - 1)
+	}
+	last, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return uint(len(capabilityMap) - 1)
+	}
+	return uint(last)
+}
+
+type capHeader struct {
+	version uint32
+	pid     int32
+}
+
+type capData struct {
+	effective   uint32
+	permitted   uint32
+	inheritable uint32
+}
+
+const linuxCapabilityVersion3 = 0x20080522
+
+// 从bounding set中去掉caps之外的capability, 之后容器进程无法再获得被去掉的能力
+// 这一步需要CAP_SETPCAP, 所以必须在切换用户和capset之前做
+func DropBoundingSet(caps []string) error {
+	mask, err := CapabilityMask(caps)
+	if err != nil {
+		return err
+	}
+	for i := uint(0); i <= lastCapability(); i++ {
+		if mask&(1<<i) != 0 {
+			continue
+		}
+		if err := unix.Prctl(unix.PR_CAPBSET_DROP, uintptr(i), 0, 0, 0); err != nil && err != unix.EINVAL {
+			return fmt.Errorf("Drop capability %d from bounding set error %v", i, err)
+		}
+	}
+	return nil
+}
+
+// 通过capset把当前线程的effective, permitted, inheritable设置为caps
+// root用户execve之后 permitted = inheritable | bounding, 所以三个集合都要设置
+// 切换到非root用户时effective会被清空, 所以capset放在切换用户之后, 切换前需要设置 PR_SET_KEEPCAPS 保留permitted
+// capset只对调用线程生效, 调用方需要先 runtime.LockOSThread()
+func ApplyCapabilities(caps []string) error {
+	mask, err := CapabilityMask(caps)
+	if err != nil {
+		return err
+	}
+	header := capHeader{version: linuxCapabilityVersion3}
+	data := [2]capData{}
+	for i := 0; i < 2; i++ {
+		v := uint32(mask >> (32 * uint(i)))
+		data[i].effective = v
+		data[i].permitted = v
+		data[i].inheritable = v
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return fmt.Errorf("Capset error %v", errno)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package container
+
+import (
+	"testing"
+)
+
+func TestTweakCapabilities(t *testing.T) {
+	caps, err := TweakCapabilities([]string{"net_admin"}, []string{"CAP_MKNOD", "kill"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := make(map[string]bool)
+	for _, c := range caps {
+		set[c] = true
+	}
+	if !set["CAP_NET_ADMIN"] || set["CAP_MKNOD"] || set["CAP_KILL"] || !set["CAP_CHOWN"] {
+		t.Fatalf("unexpected capabilities %v", caps)
+	}
+
+	caps, err = TweakCapabilities([]string{"NET_BIND_SERVICE"}, []string{"ALL"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(caps) != 1 || caps[0] != "CAP_NET_BIND_SERVICE" {
+		t.Fatalf("unexpected capabilities %v", caps)
+	}
+
+	caps, _ = TweakCapabilities(nil, nil, true)
+	if len(caps) != len(capabilityMap) {
+		t.Fatalf("privileged should keep all capabilities, got %d", len(caps))
+	}
+
+	if _, err := TweakCapabilities([]string{"CAP_FOO"}, nil, false); err == nil {
+		t.Fatal("unknown capability should fail")
+	}
+}
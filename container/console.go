@@ -0,0 +1,102 @@
+package container
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh/terminal"
+	"golang.org/x/sys/unix"
+)
+
+// 为容器分配的伪终端, master 留在paddle进程中, slave 作为容器进程的标准输入输出和控制终端
+type Console struct {
+	Master    *os.File
+	Slave     *os.File
+	SlavePath string
+}
+
+// 通过 /dev/ptmx 分配一对pty
+func NewConsole() (*Console, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Open /dev/ptmx error %v", err)
+	}
+	// 解锁slave, 相当于 unlockpt
+	if err := unix.IoctlSetPointerInt(int(master.Fd()), unix.TIOCSPTLCK, 0); err != nil {
+		master.Close()
+		return nil, fmt.Errorf("Unlock pty error %v", err)
+	}
+	// 获取slave的编号, 相当于 ptsname
+	number, err := unix.IoctlGetInt(int(master.Fd()), unix.TIOCGPTN)
+	if err != nil {
+		master.Close()
+		return nil, fmt.Errorf("Get pty number error %v", err)
+	}
+	slavePath := fmt.Sprintf("/dev/pts/%d", number)
+	slave, err := os.OpenFile(slavePath, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, fmt.Errorf("Open %s error %v", slavePath, err)
+	}
+	return &Console{
+		Master:    master,
+		Slave:     slave,
+		SlavePath: slavePath,
+	}, nil
+}
+
+// 把宿主机终端的窗口大小同步到容器的pty
+func (c *Console) ResizeFrom(f *os.File) error {
+	ws, err := unix.IoctlGetWinsize(int(f.Fd()), unix.TIOCGWINSZ)
+	if err != nil {
+		return err
+	}
+	return unix.IoctlSetWinsize(int(c.Master.Fd()), unix.TIOCSWINSZ, ws)
+}
+
+// 将宿主机终端设置为raw模式, 在宿主机终端和容器pty之间转发输入输出, 并转发窗口大小的变化
+// 返回的函数用于在容器退出之后恢复终端并停止转发
+func (c *Console) Proxy() func() {
+	stdinFd := int(os.Stdin.Fd())
+	var state *terminal.State
+	if terminal.IsTerminal(stdinFd) {
+		var err error
+		// raw模式下按键原样交给容器内的终端处理, 例如 Ctrl+C 由容器内的进程接收
+		if state, err = terminal.MakeRaw(stdinFd); err != nil {
+			log.Warnf("Set terminal raw mode error %v", err)
+		}
+		if err := c.ResizeFrom(os.Stdin); err != nil {
+			log.Warnf("Resize console error %v", err)
+		}
+	}
+
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	go func() {
+		for range winch {
+			c.ResizeFrom(os.Stdin)
+		}
+	}()
+
+	go io.Copy(c.Master, os.Stdin)
+	done := make(chan struct{})
+	go func() {
+		// 容器内所有进程关闭slave之后, 读master会返回EIO
+		io.Copy(os.Stdout, c.Master)
+		close(done)
+	}()
+
+	return func() {
+		signal.Stop(winch)
+		close(winch)
+		<-done
+		if state != nil {
+			terminal.Restore(stdinFd, state)
+		}
+		c.Master.Close()
+	}
+}
@@ -9,6 +9,10 @@ import (
 	"syscall"
 	"os/exec"
 	"os"
+	"path/filepath"
+	"github.com/IsolationWyn/paddle/image"
+	"github.com/IsolationWyn/paddle/seccomp"
+	"github.com/IsolationWyn/paddle/storage"
 )
 
 var (
@@ -18,9 +22,9 @@ var (
 	DefaultInfoLocation string = "/var/run/paddle/%s/"
 	ConfigName          string = "config.json"
 	ContainerLogFile    string = "container.log"
+	ContainerStdinFifo  string = "stdin"
 	RootUrl				string = "/root"
 	MntUrl				string = "/root/mnt/%s"
-	WriteLayerUrl 		string = "/root/writeLayer/%s"
 
 )
 
@@ -33,10 +37,39 @@ type ContainerInfo struct {
 	Status		string	`json:"status"`		// 容器的状态
 	Volume      string `json:"volume"`     //容器的数据卷
 	PortMapping []string `json:"portmapping"` //端口映射
+	Capabilities []string `json:"capabilities"` //容器进程保留的capability
+	IDMappings  *IDMappings `json:"idMappings,omitempty"` //user namespace 的uid/gid映射
+	Image       string `json:"image"`      //创建容器使用的镜像
+	ImageDigest string `json:"imageDigest,omitempty"` //创建容器时镜像manifest的digest, 镜像名之后指向其它镜像时commit仍然以它为父镜像
+	StopSignal  string `json:"stopSignal,omitempty"` //stop时发送的信号, 默认为SIGTERM
+	Labels      map[string]string `json:"labels,omitempty"` //镜像中定义的label
+	Env         []string `json:"env"`          //容器进程的环境变量, exec时沿用
+	Hooks       *Hooks   `json:"hooks,omitempty"` //容器的生命周期hook, rm时运行其中的poststop
+	Namespaces  Namespaces `json:"namespaces"` //容器拥有的namespace, 不包括与宿主机共享的
+	Pod         string `json:"pod,omitempty"` //容器所属的pod
+	IPAddress   string `json:"ipAddress,omitempty"` //连接网络之后分配到的IP
+	OomScoreAdj int    `json:"oomScoreAdj"` //容器init的oom_score_adj, exec进入的进程使用同样的值
+	WorkingDir  string `json:"workingDir,omitempty"` //用户进程的工作目录, 也是exec的默认工作目录
+	User        string `json:"user,omitempty"` //用户进程使用的 user[:group], 也是exec的默认用户
+	Seccomp     *seccomp.Seccomp `json:"seccomp,omitempty"` //容器使用的seccomp profile, exec进入的进程安装同样的过滤器
+	NoNewPrivileges bool `json:"noNewPrivileges"` //容器进程是否设置了no_new_privs
+	StorageDriver string `json:"storageDriver,omitempty"` //容器rootfs使用的存储驱动
+}
+
+// 用于传递容器安全相关配置的结构体
+type SecurityConfig struct {
+	CapAdd          []string
+	CapDrop         []string
+	Privileged      bool
+	SeccompProfile  string // seccomp profile 文件路径, 为空时使用默认profile, unconfined表示不过滤
+	NoNewPrivileges bool
+	ReadOnly        bool   // 根目录只读
+	ReadOnlyTmpfs   bool   // 只读根目录下为 /run 和 /tmp 挂载tmpfs
+	UsernsRemap     string // 使用该用户在 /etc/subuid 和 /etc/subgid 中的范围开启user namespace
 }
 
 
-func NewParentProcess(tty bool, containerName, imageName, volume string, envSlice []string) (*exec.Cmd, *os.File) {
+func NewParentProcess(console *Console, interactive bool, driver storage.Driver, containerName string, img *image.Image, volume string, namespaces Namespaces, mappings *IDMappings) (*exec.Cmd, *os.File, *os.File) {
 	/*
 	这里是父进程,也就是当前进程执行的内容
 	1. 这里的/proc/self/exe 调用中, /proc/self指的是当前运行进程自己的环境, exec 其实就是调用了自己
@@ -44,58 +77,107 @@ func NewParentProcess(tty bool, containerName, imageName, volume string, envSlic
 	2. 后面的args是参数, 其中init是传递给本进程的第一个参数, 在本例中, 其实就是会去调用initCommand去初始化进程的
 	一些环境和资源
 	3. 下面的clone参数就是去fork出来一个新进程, 并且使用了namespace隔离创建的进程和外部环境
-	4. 如果用户指定了 -ti 参数, 就需要把当前进程的输入输出导入到标准输入输出上
+	只创建namespaces中需要新建的namespace, 与宿主机共享的不创建, 加入其它容器的由调用者在启动前setns
+	4. 如果用户指定了 -ti 参数, 就把pty的slave端作为容器进程的标准输入输出, 并在新的session中设置为控制终端
+	5. 否则容器的stdout和stderr交给日志进程写入container.log, 指定了 -i 时stdin是状态目录中的一个FIFO
+	6. 第三个返回值是exec同步管道的读取端, 通过 WaitExec 等待init进程exec用户命令
 	*/
 	
 	readPipe, writePipe, err := NewPipe()
 	if err != nil {
 		log.Errorf("New pipe error %v", err)
-		return nil, nil
+		return nil, nil, nil
 	}
-
-	initCmd, err := os.Readlink("/proc/self/exe")
+	execRead, execWrite, err := NewPipe()
 	if err != nil {
-		log.Errorf("get init process error %v", err)
-		return nil, nil
-	}	
+		log.Errorf("New pipe error %v", err)
+		return nil, nil, nil
+	}
 
-	cmd := exec.Command(initCmd, "init")
+	// 通过 /proc/self/exe 执行自身, 开启user namespace时映射后的root不需要有权限访问paddle所在的目录
+	cmd := exec.Command("/proc/self/exe", "init")
 
 	// 操作系统特定的创建属性, 用于控制进程中相关属性
 	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Cloneflags: syscall.CLONE_NEWUTS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNS | 
-				syscall.CLONE_NEWNET | syscall.CLONE_NEWIPC,
+		Cloneflags: namespaces.CloneFlags(),
+	}
+	// 开启user namespace时, 由Go在子进程运行之前写好uid_map和gid_map
+	// 其它namespace和user namespace在同一次clone中创建, 归属于新的user namespace
+	// init进程必须以容器内的root身份exec: 宿主机的root在新的user namespace中没有映射, exec时会失去所有capability, 之后的挂载都会失败
+	if mappings != nil {
+		cmd.SysProcAttr.UidMappings = mappings.UidMappings
+		cmd.SysProcAttr.GidMappings = mappings.GidMappings
+		cmd.SysProcAttr.GidMappingsEnableSetgroups = true
+		cmd.SysProcAttr.Credential = &syscall.Credential{Uid: 0, Gid: 0}
 	}
-	if tty {
-		cmd.Stdin = os.Stdin
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
+	if console != nil {
+		cmd.Stdin = console.Slave
+		cmd.Stdout = console.Slave
+		cmd.Stderr = console.Slave
+		cmd.SysProcAttr.Setsid = true
+		cmd.SysProcAttr.Setctty = true
+		cmd.SysProcAttr.Ctty = 0
 	} else {
-		// 生成容器对应目录的container.log文件
+		// 生成容器对应目录, container.log 和 stdin 都放在这里
 		dirURL := fmt.Sprintf(DefaultInfoLocation, containerName)
 		if err := os.MkdirAll(dirURL, 0622); err != nil {
 			log.Errorf("NewParentProcess mkdir %s error %v", dirURL, err)
-			return nil, nil
+			return nil, nil, nil
 		}
-		// /var/run/paddle/{{containerName}}/container.log
-		stdLogFilePath := dirURL + ContainerLogFile
-		stdLogFile, err := os.Create(stdLogFilePath)
+		// stdout和stderr分别写入两个管道, 由日志进程打上stream标签之后写入 container.log
+		stdout, stderr, err := StartLogger(containerName)
 		if err != nil {
-			log.Errorf("NewParentProcess create file %s error %v", stdLogFilePath, err)
-			return nil, nil
+			log.Errorf("NewParentProcess start logger error %v", err)
+			return nil, nil, nil
 		}
-		// 把生成好的文件赋值给stdout, 这样就能把容器内的标准输出重定向到这个文件中
-		cmd.Stdout = stdLogFile
-	}	
-		
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+		// -d -i 时保留一个打开的stdin, 没有 -i 时stdin为 /dev/null
+		if interactive {
+			stdin, err := OpenStdinFifo(containerName)
+			if err != nil {
+				log.Errorf("NewParentProcess open stdin error %v", err)
+				return nil, nil, nil
+			}
+			cmd.Stdin = stdin
+		}
+		// 容器的session与paddle分离, 终端关闭时不会收到SIGHUP
+		cmd.SysProcAttr.Setsid = true
+	}
+
 	// 传入管道文件读取端的句柄
 	// 一个进程默认有三个文件描述符(标准输入标准输出标准错误)
-	cmd.ExtraFiles = []*os.File{readPipe}
-	cmd.Env = append(os.Environ(), envSlice...)
+	// exec同步管道的写入端是fd 4, init进程exec成功时它随之关闭, 失败时错误信息写入其中
+	cmd.ExtraFiles = []*os.File{readPipe, execWrite}
+	// 不把paddle的环境变量泄露给容器, 容器的环境变量通过InitConfig传给init进程
+	cmd.Env = []string{}
 	// TODO: rootURL := "/root/"
-	NewWorkSpace(volume, imageName, containerName)
+	if err := NewWorkSpace(driver, volume, img, containerName, mappings); err != nil {
+		log.Errorf("New workspace error %v", err)
+		return nil, nil, nil
+	}
 	cmd.Dir = fmt.Sprintf(MntUrl, containerName)
-	return cmd, writePipe
+	// 子进程在切换到容器root之后才chdir到rootfs, 映射后的root需要能够进入rootfs所在的目录
+	if mappings != nil {
+		if err := MakeTraversable(filepath.Dir(cmd.Dir)); err != nil {
+			log.Errorf("Make %s traversable error %v", cmd.Dir, err)
+			return nil, nil, nil
+		}
+	}
+	return cmd, writePipe, execRead
+}
+
+// 等待init进程exec用户命令, 成功时init不写入任何内容, 管道在exec时关闭
+// 读到内容说明init在exec之前失败, 内容就是错误信息
+func WaitExec(execRead *os.File) error {
+	msg, err := ioutil.ReadAll(execRead)
+	if err != nil {
+		return err
+	}
+	if len(msg) > 0 {
+		return fmt.Errorf("%s", msg)
+	}
+	return nil
 }
 
 func NewPipe() (*os.File, *os.File, error) {
@@ -129,14 +211,28 @@ func GetContainerInfo(file os.FileInfo) (*ContainerInfo, error) {
 }
 
 // NewWorkSpace函数是用来创建容器文件系统的, 它包括CreateReadOnlyLayer, CreateWriteLayer和CreateMountPoint
-// CreateReadOnlyLayer函数新建busybox文件夹, 将busybox.tar解压到busybox目录下, 作为容器的只读层
-// CreateWriteLayer函数创建一个名为writeLayer的文件夹, 作为容器唯一的可写层
-// 在CreateMountPoint函数中, 首先创建了mnt文件夹, 作为挂载点, 然后把writeLayer目录和busybox目录mount到mnt目录下
+// CreateReadOnlyLayer函数从镜像存储中找到镜像, 由存储驱动按顺序解压它的每个层, 作为容器的只读层
+// CreateWriteLayer函数以镜像的最上层为父层创建一个以容器名命名的层, 作为容器唯一的可写层
+// 在CreateMountPoint函数中, 首先创建了mnt文件夹, 作为挂载点, 然后由存储驱动把可写层和镜像的所有层mount到mnt目录下
 
-func NewWorkSpace(volume, imageName, containerName string) {
-	CreateReadOnlyLayer(imageName)
-	CreateWriteLayer(containerName)
-	CreateMountPoint(containerName, imageName)
+func NewWorkSpace(driver storage.Driver, volume string, img *image.Image, containerName string, mappings *IDMappings) error {
+	imageLayer, err := CreateReadOnlyLayer(driver, img)
+	if err != nil {
+		return err
+	}
+	// user namespace 下使用属主平移过的只读层
+	if mappings != nil {
+		if imageLayer, err = CreateRemappedLayer(driver, imageLayer, mappings); err != nil {
+			return err
+		}
+	}
+	if err := CreateWriteLayer(driver, containerName, imageLayer, mappings); err != nil {
+		return err
+	}
+	if err := CreateMountPoint(driver, containerName); err != nil {
+		DeleteWriteLayer(driver, containerName)
+		return err
+	}
 	if volume != "" {
 		volumeURLs := strings.Split(volume, ":")
 		length := len(volumeURLs)
@@ -147,39 +243,39 @@ func NewWorkSpace(volume, imageName, containerName string) {
 			log.Infof("Volume parameter input is not correct.")
 		}
 	}
+	return nil
 }
 
 
-//Decompression tar image
-func CreateReadOnlyLayer(imageName string) error {
-	unTarFolderUrl := RootUrl + "/" + imageName + "/"
-	imageUrl := RootUrl + "/" + imageName + ".tar"
-	exist, err := PathExists(unTarFolderUrl)
+// 解压镜像的所有层, 返回最上层在存储驱动中的id
+// 镜像由调用者解析一次, 容器使用的层和记录在容器信息中的digest始终一致
+func CreateReadOnlyLayer(driver storage.Driver, img *image.Image) (string, error) {
+	store := image.NewStore(image.DefaultRoot)
+	imageLayer, err := store.Unpack(driver, img)
 	if err != nil {
-		log.Infof("Fail to judge whether dir %s exists. %v", unTarFolderUrl, err)
-		return err
+		log.Errorf("Unpack image %s error %v", img.Name, err)
+		return "", err
 	}
-	if !exist {
-		if err := os.MkdirAll(unTarFolderUrl, 0622); err != nil {
-			log.Errorf("Mkdir %s error %v", unTarFolderUrl, err)
-			return err
-		}
+	return imageLayer, nil
+}
 
-		if _, err := exec.Command("tar", "-xvf", imageUrl, "-C", unTarFolderUrl).CombinedOutput(); err != nil {
-			log.Errorf("Untar dir %s error %v", unTarFolderUrl, err)
-			return err
+func CreateWriteLayer(driver storage.Driver, containerName, imageLayer string, mappings *IDMappings) error {
+	if err := driver.CreateReadWrite(containerName, imageLayer); err != nil {
+		log.Errorf("Create write layer %s error %v", containerName, err)
+		return err
+	}
+	// 可写层属于容器内的root, 否则映射后的root无法写入
+	if mappings != nil {
+		uid, gid := mappings.RootPair()
+		writeURL := driver.Dir(containerName)
+		if err := os.Chown(writeURL, uid, gid); err != nil {
+			log.Infof("Chown write layer dir %s error. %v", writeURL, err)
 		}
 	}
 	return nil
 }
 
-func CreateWriteLayer(containerName string) {
-	writeURL := fmt.Sprintf(WriteLayerUrl, containerName)
-	if err := os.MkdirAll(writeURL, 0777); err != nil {
-		log.Infof("Mkdir write layer dir %s error. %v", writeURL, err)
-	}
-}
-
+// 数据卷直接bind到容器rootfs中, 容器内的修改直接写到宿主机的目录
 func MountVolume(volumeURLs []string, containerName string) error {
 	parentUrl := volumeURLs[0]
 	if err := os.Mkdir(parentUrl, 0777); err != nil {
@@ -191,35 +287,28 @@ func MountVolume(volumeURLs []string, containerName string) error {
 	if err := os.Mkdir(containerVolumeURL, 0777); err != nil {
 		log.Infof("Mkdir container dir %s error. %v", containerVolumeURL, err)
 	}
-	dirs := "dirs=" + parentUrl
-	_, err := exec.Command("mount", "-t", "aufs", "-o", dirs, "none", containerVolumeURL).CombinedOutput()
-	if err != nil {
+	if err := syscall.Mount(parentUrl, containerVolumeURL, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
 		log.Errorf("Mount volume failed. %v", err)
 		return err
 	}
 	return nil
 }
 
-func CreateMountPoint(containerName , imageName string) error {
+func CreateMountPoint(driver storage.Driver, containerName string) error {
 	mntUrl := fmt.Sprintf(MntUrl, containerName)
 	if err := os.MkdirAll(mntUrl, 0777); err != nil {
 		log.Errorf("Mkdir mountpoint dir %s error. %v", mntUrl, err)
 		return err
 	}
-	tmpWriteLayer := fmt.Sprintf(WriteLayerUrl, containerName)
-	tmpImageLocation := RootUrl + "/" + imageName
-	mntURL := fmt.Sprintf(MntUrl, containerName)
-	dirs := "dirs=" + tmpWriteLayer + ":" + tmpImageLocation
-	_, err := exec.Command("mount", "-t", "aufs", "-o", dirs, "none", mntURL).CombinedOutput()
-	if err != nil {
-		log.Errorf("Run command for creating mount point failed %v", err)
+	if err := driver.Mount(containerName, mntUrl); err != nil {
+		log.Errorf("Mount rootfs of %s error %v", containerName, err)
 		return err
 	}
 	return nil
 }
 
-//Delete the AUFS filesystem while container exit
-func DeleteWorkSpace(volume, containerName string) {
+//Delete the container filesystem while container exit
+func DeleteWorkSpace(driver storage.Driver, volume, containerName string) {
 	if volume != "" {
 		volumeURLs := strings.Split(volume, ":")
 		length := len(volumeURLs)
@@ -227,14 +316,16 @@ func DeleteWorkSpace(volume, containerName string) {
 			DeleteVolume(volumeURLs, containerName)
 		}
 	}
-	DeleteMountPoint(containerName)
-	DeleteWriteLayer(containerName)
+	// 卸载失败时保留可写层, 避免删除仍然挂载着的rootfs中的内容
+	if err := DeleteMountPoint(driver, containerName); err != nil {
+		return
+	}
+	DeleteWriteLayer(driver, containerName)
 }
 
-func DeleteMountPoint(containerName string) error {
+func DeleteMountPoint(driver storage.Driver, containerName string) error {
 	mntURL := fmt.Sprintf(MntUrl, containerName)
-	_, err := exec.Command("umount", mntURL).CombinedOutput()
-	if err != nil {
+	if err := driver.Unmount(mntURL); err != nil {
 		log.Errorf("Unmount %s error %v", mntURL, err)
 		return err
 	}
@@ -248,17 +339,16 @@ func DeleteMountPoint(containerName string) error {
 func DeleteVolume(volumeURLs []string, containerName string) error {
 	mntURL := fmt.Sprintf(MntUrl, containerName)
 	containerUrl := mntURL + "/" +  volumeURLs[1]
-	if _, err := exec.Command("umount", containerUrl).CombinedOutput(); err != nil {
+	if err := syscall.Unmount(containerUrl, 0); err != nil {
 		log.Errorf("Umount volume %s failed. %v", containerUrl, err)
 		return err
 	}
 	return nil
 }
 
-func DeleteWriteLayer(containerName string) {
-	writeURL := fmt.Sprintf(WriteLayerUrl, containerName)
-	if err := os.RemoveAll(writeURL); err != nil {
-		log.Infof("Remove writeLayer dir %s error %v", writeURL, err)
+func DeleteWriteLayer(driver storage.Driver, containerName string) {
+	if err := driver.Remove(containerName); err != nil {
+		log.Infof("Remove write layer %s error %v", containerName, err)
 	}
 }
 
@@ -0,0 +1,265 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// /dev/shm 的默认大小, 与docker一致为64M
+const DefaultShmSize int64 = 64 * 1024 * 1024
+
+// 容器内的一个设备节点
+type Device struct {
+	Path        string      `json:"path"`        // 容器内的路径
+	Source      string      `json:"source"`      // 宿主机上的路径
+	Type        string      `json:"type"`        // c 字符设备, b 块设备
+	Major       int64       `json:"major"`       // 主设备号, -1 表示任意
+	Minor       int64       `json:"minor"`       // 次设备号, -1 表示任意
+	FileMode    os.FileMode `json:"fileMode"`    // 节点的权限
+	Permissions string      `json:"permissions"` // devices cgroup 中的访问权限, r 读 w 写 m mknod
+}
+
+// 用于传递设备相关配置的结构体
+type DeviceConfig struct {
+	Devices []*Device // 通过 --device 传入容器的宿主机设备
+	ShmSize int64     // /dev/shm 的大小
+}
+
+// 每个容器都会创建的标准设备节点
+var DefaultDevices = []*Device{
+	{Path: "/dev/null", Type: "c", Major: 1, Minor: 3, FileMode: 0666, Permissions: "rwm"},
+	{Path: "/dev/zero", Type: "c", Major: 1, Minor: 5, FileMode: 0666, Permissions: "rwm"},
+	{Path: "/dev/full", Type: "c", Major: 1, Minor: 7, FileMode: 0666, Permissions: "rwm"},
+	{Path: "/dev/random", Type: "c", Major: 1, Minor: 8, FileMode: 0666, Permissions: "rwm"},
+	{Path: "/dev/urandom", Type: "c", Major: 1, Minor: 9, FileMode: 0666, Permissions: "rwm"},
+	{Path: "/dev/tty", Type: "c", Major: 5, Minor: 0, FileMode: 0666, Permissions: "rwm"},
+}
+
+// 除了标准设备节点之外, devices cgroup 中还需要放行的规则
+var defaultDeviceRules = []string{
+	// 允许mknod任意设备, 但是没有读写权限
+	"c *:* m",
+	"b *:* m",
+	// /dev/console
+	"c 5:1 rwm",
+	// /dev/pts/ptmx
+	"c 5:2 rwm",
+	// /dev/pts/*
+	"c 136:* rwm",
+	// /dev/net/tun
+	"c 10:200 rwm",
+}
+
+// 解析 --device 参数, 格式为 /dev/foo[:/dev/bar][:rwm]
+func ParseDevice(spec string) (*Device, error) {
+	parts := strings.Split(spec, ":")
+	hostPath := parts[0]
+	containerPath := hostPath
+	permissions := "rwm"
+	switch len(parts) {
+	case 1:
+	case 2:
+		if validDevicePermissions(parts[1]) {
+			permissions = parts[1]
+		} else {
+			containerPath = parts[1]
+		}
+	case 3:
+		containerPath = parts[1]
+		permissions = parts[2]
+	default:
+		return nil, fmt.Errorf("Invalid device specification %s", spec)
+	}
+	if !validDevicePermissions(permissions) {
+		return nil, fmt.Errorf("Invalid device permissions %s", permissions)
+	}
+	if !filepath.IsAbs(containerPath) {
+		return nil, fmt.Errorf("Device path %s in container must be absolute", containerPath)
+	}
+
+	device, err := deviceFromPath(hostPath, permissions)
+	if err != nil {
+		return nil, err
+	}
+	device.Source = hostPath
+	device.Path = containerPath
+	return device, nil
+}
+
+func validDevicePermissions(permissions string) bool {
+	if permissions == "" {
+		return false
+	}
+	for _, c := range permissions {
+		if c != 'r' && c != 'w' && c != 'm' {
+			return false
+		}
+	}
+	return true
+}
+
+// 读取宿主机上设备节点的类型和设备号
+func deviceFromPath(path, permissions string) (*Device, error) {
+	var stat syscall.Stat_t
+	if err := syscall.Stat(path, &stat); err != nil {
+		return nil, fmt.Errorf("Stat device %s error %v", path, err)
+	}
+	var devType string
+	switch stat.Mode & syscall.S_IFMT {
+	case syscall.S_IFCHR:
+		devType = "c"
+	case syscall.S_IFBLK:
+		devType = "b"
+	default:
+		return nil, fmt.Errorf("%s is not a device node", path)
+	}
+	return &Device{
+		Path:        path,
+		Type:        devType,
+		Major:       int64(unix.Major(uint64(stat.Rdev))),
+		Minor:       int64(unix.Minor(uint64(stat.Rdev))),
+		FileMode:    os.FileMode(stat.Mode &^ syscall.S_IFMT),
+		Permissions: permissions,
+	}, nil
+}
+
+// 生成 devices.allow 中的一条规则, 例如 c 1:3 rwm
+func (d *Device) CgroupRule() string {
+	number := func(n int64) string {
+		if n < 0 {
+			return "*"
+		}
+		return fmt.Sprintf("%d", n)
+	}
+	return fmt.Sprintf("%s %s:%s %s", d.Type, number(d.Major), number(d.Minor), d.Permissions)
+}
+
+// 容器的devices cgroup规则: 标准设备节点, 默认规则以及 --device 传入的设备
+func DeviceCgroupRules(devices []*Device) []string {
+	var rules []string
+	for _, d := range DefaultDevices {
+		rules = append(rules, d.CgroupRule())
+	}
+	rules = append(rules, defaultDeviceRules...)
+	for _, d := range devices {
+		rules = append(rules, d.CgroupRule())
+	}
+	return rules
+}
+
+// 在容器的 /dev 下创建设备节点
+// user namespace 中不允许mknod, 此时创建一个空文件并把宿主机上的设备节点bind过来
+func createDevice(rootfs string, d *Device, bind bool) error {
+	target := filepath.Join(rootfs, d.Path)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	os.Remove(target)
+	if bind {
+		f, err := os.OpenFile(target, os.O_CREATE, 0755)
+		if err != nil {
+			return err
+		}
+		f.Close()
+		if err := syscall.Mount(d.HostPath(), target, "bind", syscall.MS_BIND, ""); err != nil {
+			return fmt.Errorf("Bind device %s error %v", d.HostPath(), err)
+		}
+		return nil
+	}
+	mode := uint32(d.FileMode)
+	if d.Type == "b" {
+		mode |= syscall.S_IFBLK
+	} else {
+		mode |= syscall.S_IFCHR
+	}
+	if err := syscall.Mknod(target, mode, int(unix.Mkdev(uint32(d.Major), uint32(d.Minor)))); err != nil {
+		return fmt.Errorf("Mknod %s error %v", d.Path, err)
+	}
+	// mknod 会受到umask影响, 需要再设置一次权限
+	return os.Chmod(target, d.FileMode)
+}
+
+// 设备在宿主机上的路径, 没有指定时与容器内路径相同
+func (d *Device) HostPath() string {
+	if d.Source != "" {
+		return d.Source
+	}
+	return d.Path
+}
+
+// 初始化容器的 /dev, 在 pivotRoot 之前进行, 这样 user namespace 下还可以访问宿主机的设备节点
+// 1. 挂载tmpfs并创建标准设备节点和 --device 传入的设备
+// 2. 创建 /dev/fd, /dev/stdin 等指向 /proc/self/fd 的软链接
+// 3. 挂载私有的devpts, /dev/ptmx 指向 /dev/pts/ptmx, 这样容器只能看到自己的pty
+// 4. 挂载 /dev/shm 和 /dev/mqueue
+func setUpDev(rootfs string, initConfig *InitConfig) error {
+	devDir := filepath.Join(rootfs, "dev")
+	if err := os.MkdirAll(devDir, 0755); err != nil {
+		return fmt.Errorf("Mkdir %s error %v", devDir, err)
+	}
+	if err := syscall.Mount("tmpfs", devDir, "tmpfs", syscall.MS_NOSUID|syscall.MS_STRICTATIME, "mode=755,size=65536k"); err != nil {
+		return fmt.Errorf("Mount /dev error %v", err)
+	}
+
+	oldMask := syscall.Umask(0)
+	defer syscall.Umask(oldMask)
+
+	for _, d := range append(DefaultDevices, initConfig.Devices...) {
+		if err := createDevice(rootfs, d, initConfig.UserNamespace); err != nil {
+			return err
+		}
+	}
+
+	// 把pty的slave端bind到 /dev/console, 此时还没有pivotRoot, 可以通过 /proc/self/fd/0 找到宿主机上的slave
+	if initConfig.Console {
+		console := &Device{Path: "/dev/console", Source: "/proc/self/fd/0"}
+		if err := createDevice(rootfs, console, true); err != nil {
+			return err
+		}
+	}
+
+	links := [][2]string{
+		{"/proc/self/fd", "/dev/fd"},
+		{"/proc/self/fd/0", "/dev/stdin"},
+		{"/proc/self/fd/1", "/dev/stdout"},
+		{"/proc/self/fd/2", "/dev/stderr"},
+		{"/proc/kcore", "/dev/core"},
+		{"pts/ptmx", "/dev/ptmx"},
+	}
+	for _, link := range links {
+		if err := os.Symlink(link[0], filepath.Join(rootfs, link[1])); err != nil && !os.IsExist(err) {
+			return fmt.Errorf("Symlink %s to %s error %v", link[1], link[0], err)
+		}
+	}
+
+	mounts := []struct {
+		source, target, fstype string
+		flags                  uintptr
+		data                   string
+	}{
+		{"devpts", "/dev/pts", "devpts", syscall.MS_NOSUID | syscall.MS_NOEXEC, "newinstance,ptmxmode=0666,mode=0620,gid=5"},
+		{"shm", "/dev/shm", "tmpfs", syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC, fmt.Sprintf("mode=1777,size=%d", initConfig.ShmSize)},
+		{"mqueue", "/dev/mqueue", "mqueue", syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC, ""},
+	}
+	for _, m := range mounts {
+		target := filepath.Join(rootfs, m.target)
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return fmt.Errorf("Mkdir %s error %v", m.target, err)
+		}
+		if err := syscall.Mount(m.source, target, m.fstype, m.flags, m.data); err != nil {
+			// 部分内核没有开启mqueue, 不影响容器运行
+			if m.fstype == "mqueue" {
+				log.Warnf("Mount %s error %v", m.target, err)
+				continue
+			}
+			return fmt.Errorf("Mount %s error %v", m.target, err)
+		}
+	}
+	return nil
+}
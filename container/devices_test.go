@@ -0,0 +1,30 @@
+package container
+
+import (
+	"testing"
+)
+
+func TestParseDevice(t *testing.T) {
+	d, err := ParseDevice("/dev/null:/dev/mynull:rw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Path != "/dev/mynull" || d.CgroupRule() != "c 1:3 rw" {
+		t.Fatalf("unexpected device %+v", d)
+	}
+
+	d, err = ParseDevice("/dev/null:r")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Path != "/dev/null" || d.Permissions != "r" {
+		t.Fatalf("unexpected device %+v", d)
+	}
+
+	if _, err := ParseDevice("/dev/null:/dev/mynull:rwx"); err == nil {
+		t.Fatal("invalid permissions should fail")
+	}
+	if _, err := ParseDevice("/etc/hostname"); err == nil {
+		t.Fatal("regular file should fail")
+	}
+}
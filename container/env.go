@@ -0,0 +1,37 @@
+package container
+
+import (
+	"os"
+	"strings"
+)
+
+// 镜像没有设置PATH时使用的默认值, 与docker相同
+const DefaultPathEnv = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// 容器进程的默认环境变量, 镜像配置和 -e 中的同名变量会覆盖它们
+// HOME 取决于容器内 /etc/passwd 中用户的home目录, 由init进程在切换用户之前补上
+// 与docker一致, 只有分配了pty时才设置 TERM
+func DefaultEnv(hostname string, tty bool) []string {
+	env := []string{
+		"PATH=" + DefaultPathEnv,
+		"HOSTNAME=" + hostname,
+	}
+	if tty {
+		env = append(env, "TERM=xterm")
+	}
+	return env
+}
+
+// 用容器的环境变量替换当前进程的环境变量, 之后的 exec.LookPath 使用容器的PATH查找命令
+func setupEnv(env []string, home string) {
+	os.Clearenv()
+	for _, kv := range env {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 2 {
+			os.Setenv(parts[0], parts[1])
+		}
+	}
+	if _, ok := os.LookupEnv("HOME"); !ok {
+		os.Setenv("HOME", home)
+	}
+}
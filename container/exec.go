@@ -0,0 +1,205 @@
+package container
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// 用于传递 paddle exec 参数的结构体
+type ExecConfig struct {
+	Tty        bool     // 为进程分配pty
+	Detach     bool     // 在后台运行, 不等待进程退出
+	Env        []string // 在容器环境变量的基础上追加或覆盖的变量
+	WorkingDir string   // 为空时使用容器的工作目录
+	User       string   // user[:group], 为空时使用容器的用户
+}
+
+// 通过管道传给nsenter的配置, 不使用环境变量, 避免出现在容器进程的 /proc/<pid>/environ 中
+type NsenterConfig struct {
+	Pid             string   // 容器init进程在宿主机上的PID
+	Namespaces      []string // 按加入顺序排列的namespace类型
+	Args            []string // 要运行的命令
+	Cwd             string
+	Uid             int
+	Gid             int
+	Groups          []int
+	CapMask         uint64
+	NoNewPrivileges bool
+}
+
+// 编码为一组以'\0'结尾的 key=value, 最后是一个空记录
+// ns, arg 和 group 可以重复出现, nsenter按出现的顺序使用它们
+func (c *NsenterConfig) Encode() []byte {
+	var buf bytes.Buffer
+	record := func(key, value string) {
+		buf.WriteString(key + "=" + value)
+		buf.WriteByte(0)
+	}
+	record("pid", c.Pid)
+	for _, ns := range c.Namespaces {
+		record("ns", ns)
+	}
+	for _, arg := range c.Args {
+		record("arg", arg)
+	}
+	record("cwd", c.Cwd)
+	record("uid", strconv.Itoa(c.Uid))
+	record("gid", strconv.Itoa(c.Gid))
+	for _, gid := range c.Groups {
+		record("group", strconv.Itoa(gid))
+	}
+	record("caps", strconv.FormatUint(c.CapMask, 10))
+	if c.NoNewPrivileges {
+		record("nnp", "1")
+	}
+	buf.WriteByte(0)
+	return buf.Bytes()
+}
+
+// exec会话的状态
+const (
+	ExecRunning = "running"
+	ExecExited  = "exited"
+	ExecUnknown = "unknown" // nsenter没有记录退出码就退出了, 例如被SIGKILL杀死
+)
+
+// 容器状态目录下存放exec会话的目录, 每个会话一个子目录
+var ExecSessionDir string = "exec"
+
+// 一次 paddle exec, 保存在 /var/run/paddle/<容器名>/exec/<会话ID>/config.json
+type ExecSession struct {
+	Id        string   `json:"id"`
+	Container string   `json:"container"`
+	Command   []string `json:"command"`
+	User      string   `json:"user"` // 运行命令的 uid:gid
+	Pid       int      `json:"pid"`  // nsenter在宿主机上的PID
+	Detached  bool     `json:"detached"`
+	StartTime string   `json:"startTime"`
+}
+
+// nsenter在会话目录的 status 文件中追加的记录, pid=<命令的PID> 和 exit=<退出码>
+type ExecStatus struct {
+	Status   string
+	Pid      int // 命令在宿主机上的PID
+	ExitCode int
+	EndTime  string
+}
+
+func ExecSessionPath(containerName, id string) string {
+	return fmt.Sprintf(DefaultInfoLocation, containerName) + ExecSessionDir + "/" + id + "/"
+}
+
+// 创建会话目录, 返回的 status 文件交给nsenter写入命令的PID和退出码
+func NewExecSession(session *ExecSession) (*os.File, error) {
+	dirURL := ExecSessionPath(session.Container, session.Id)
+	if err := os.MkdirAll(dirURL, 0700); err != nil {
+		return nil, fmt.Errorf("Mkdir %s error %v", dirURL, err)
+	}
+	session.StartTime = time.Now().Format("2006-01-02 15:04:05")
+	if err := session.Save(); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(dirURL+"status", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+}
+
+func (s *ExecSession) Save() error {
+	jsonBytes, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(ExecSessionPath(s.Container, s.Id)+ConfigName, jsonBytes, 0600)
+}
+
+// 根据nsenter写入的记录得到会话的当前状态, 结束时间取 status 文件最后修改的时间
+func (s *ExecSession) Status() *ExecStatus {
+	status := &ExecStatus{Status: ExecRunning, ExitCode: -1}
+	path := ExecSessionPath(s.Container, s.Id) + "status"
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		status.Status = ExecUnknown
+		return status
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value, _ := strconv.Atoi(parts[1])
+		switch parts[0] {
+		case "pid":
+			status.Pid = value
+		case "exit":
+			status.Status = ExecExited
+			status.ExitCode = value
+			if info, err := os.Stat(path); err == nil {
+				status.EndTime = info.ModTime().Format("2006-01-02 15:04:05")
+			}
+		}
+	}
+	if status.Status == ExecRunning && syscall.Kill(s.Pid, 0) == syscall.ESRCH {
+		status.Status = ExecUnknown
+	}
+	return status
+}
+
+// 容器的所有exec会话, 按开始时间排序
+func ListExecSessions(containerName string) ([]*ExecSession, error) {
+	dirURL := fmt.Sprintf(DefaultInfoLocation, containerName) + ExecSessionDir
+	files, err := ioutil.ReadDir(dirURL)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var sessions []*ExecSession
+	for _, file := range files {
+		session, err := getExecSession(containerName, file.Name())
+		if err != nil {
+			log.Errorf("Get exec session %s error %v", file.Name(), err)
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].StartTime < sessions[j].StartTime
+	})
+	return sessions, nil
+}
+
+// 在所有容器中查找会话
+func FindExecSession(id string) (*ExecSession, error) {
+	dirURL := fmt.Sprintf(DefaultInfoLocation, "")
+	files, err := ioutil.ReadDir(dirURL)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if session, err := getExecSession(file.Name(), id); err == nil {
+			return session, nil
+		}
+	}
+	return nil, fmt.Errorf("No such exec session %s", id)
+}
+
+func getExecSession(containerName, id string) (*ExecSession, error) {
+	content, err := ioutil.ReadFile(ExecSessionPath(containerName, id) + ConfigName)
+	if err != nil {
+		return nil, err
+	}
+	var session ExecSession
+	if err := json.Unmarshal(content, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
@@ -0,0 +1,68 @@
+package container
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestNsenterConfigEncode(t *testing.T) {
+	config := &NsenterConfig{
+		Pid:             "42",
+		Namespaces:      []string{"net", "mnt"},
+		Args:            []string{"sh", "-c", "echo a  b"},
+		Cwd:             "/",
+		Uid:             1000,
+		Gid:             1000,
+		Groups:          []int{10},
+		CapMask:         5,
+		NoNewPrivileges: true,
+	}
+	records := bytes.Split(config.Encode(), []byte{0})
+	expected := []string{
+		"pid=42", "ns=net", "ns=mnt", "arg=sh", "arg=-c", "arg=echo a  b",
+		"cwd=/", "uid=1000", "gid=1000", "group=10", "caps=5", "nnp=1", "", "",
+	}
+	if len(records) != len(expected) {
+		t.Fatalf("unexpected records %q", records)
+	}
+	for i, record := range records {
+		if string(record) != expected[i] {
+			t.Fatalf("record %d: expected %q, got %q", i, expected[i], record)
+		}
+	}
+}
+
+func TestExecSessionStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "paddle-exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(location string) { DefaultInfoLocation = location }(DefaultInfoLocation)
+	DefaultInfoLocation = dir + "/%s/"
+
+	session := &ExecSession{Id: "abc", Container: "web", Command: []string{"sh"}, Pid: os.Getpid()}
+	statusFile, err := NewExecSession(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer statusFile.Close()
+	fmt.Fprintf(statusFile, "pid=%d\n", 42)
+	if status := session.Status(); status.Status != ExecRunning || status.Pid != 42 {
+		t.Fatalf("expected running with pid 42, got %+v", status)
+	}
+	fmt.Fprintf(statusFile, "exit=%d\n", 137)
+	if status := session.Status(); status.Status != ExecExited || status.ExitCode != 137 || status.EndTime == "" {
+		t.Fatalf("expected exited with code 137, got %+v", status)
+	}
+
+	if found, err := FindExecSession("abc"); err != nil || found.Container != "web" {
+		t.Fatalf("FindExecSession: %v %+v", err, found)
+	}
+	if sessions, err := ListExecSessions("web"); err != nil || len(sessions) != 1 {
+		t.Fatalf("ListExecSessions: %v %d", err, len(sessions))
+	}
+}
@@ -0,0 +1,169 @@
+package container
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// 实现的OCI runtime spec版本, 写入传给hook的state中
+const OCIVersion = "1.0.2"
+
+// hook没有指定timeout时的超时时间
+const DefaultHookTimeout = 30 * time.Second
+
+// 全局配置文件, 其中的hooks对所有容器生效
+var DaemonConfigFile string = "/etc/paddle/daemon.json"
+
+// OCI定义的一个hook, Args 与 execve 相同, 包括 argv[0]
+type Hook struct {
+	Path    string   `json:"path"`
+	Args    []string `json:"args,omitempty"`
+	Env     []string `json:"env,omitempty"`
+	Timeout *int     `json:"timeout,omitempty"` // 单位为秒
+}
+
+// 容器生命周期中各个时间点需要运行的hook
+// prestart 和 createRuntime 在容器的namespace创建之后, 用户进程运行之前, 在宿主机的namespace中运行, 失败会终止容器的创建
+// poststart 在init进程exec用户命令之后运行, poststop 在容器被删除之后运行, 它们失败只会打印警告
+type Hooks struct {
+	Prestart      []Hook `json:"prestart,omitempty"`
+	CreateRuntime []Hook `json:"createRuntime,omitempty"`
+	Poststart     []Hook `json:"poststart,omitempty"`
+	Poststop      []Hook `json:"poststop,omitempty"`
+}
+
+// 通过stdin传给hook的容器状态, 格式与OCI runtime的state相同
+type State struct {
+	OCIVersion  string            `json:"ociVersion"`
+	ID          string            `json:"id"`
+	Status      string            `json:"status"`
+	Pid         int               `json:"pid,omitempty"`
+	Bundle      string            `json:"bundle"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type DaemonConfig struct {
+	Hooks         Hooks  `json:"hooks"`
+	StorageDriver string `json:"storage-driver,omitempty"` // 没有指定 --storage-driver 时使用的存储驱动, 为空时自动检测
+	ImageRoot     string `json:"image-root,omitempty"`     // 镜像存储的根目录
+}
+
+// 读取全局配置文件, 文件不存在时返回空配置
+func LoadDaemonConfig() (*DaemonConfig, error) {
+	config := &DaemonConfig{}
+	content, err := ioutil.ReadFile(DaemonConfigFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return config, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(content, config); err != nil {
+		return nil, fmt.Errorf("Unmarshal %s error %v", DaemonConfigFile, err)
+	}
+	if err := config.Hooks.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", DaemonConfigFile, err)
+	}
+	return config, nil
+}
+
+// 读取 --hooks 指定的文件, 格式与OCI config.json中的hooks字段相同
+func LoadHooks(path string) (*Hooks, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	hooks := &Hooks{}
+	if err := json.Unmarshal(content, hooks); err != nil {
+		return nil, fmt.Errorf("Unmarshal hooks %s error %v", path, err)
+	}
+	if err := hooks.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return hooks, nil
+}
+
+func (h *Hooks) validate() error {
+	for _, hooks := range [][]Hook{h.Prestart, h.CreateRuntime, h.Poststart, h.Poststop} {
+		for _, hook := range hooks {
+			if !filepath.IsAbs(hook.Path) {
+				return fmt.Errorf("hook path %q must be absolute", hook.Path)
+			}
+			if hook.Timeout != nil && *hook.Timeout <= 0 {
+				return fmt.Errorf("hook %s timeout must be positive", hook.Path)
+			}
+		}
+	}
+	return nil
+}
+
+// 合并两组hook, 同一个时间点上先运行h中的, 再运行other中的
+func (h *Hooks) Merge(other *Hooks) *Hooks {
+	if other == nil {
+		return h
+	}
+	return &Hooks{
+		Prestart:      append(append([]Hook{}, h.Prestart...), other.Prestart...),
+		CreateRuntime: append(append([]Hook{}, h.CreateRuntime...), other.CreateRuntime...),
+		Poststart:     append(append([]Hook{}, h.Poststart...), other.Poststart...),
+		Poststop:      append(append([]Hook{}, h.Poststop...), other.Poststop...),
+	}
+}
+
+// 依次运行一组hook, 遇到第一个失败的hook就返回
+func RunHooks(hooks []Hook, state *State) error {
+	stateBytes, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	for _, hook := range hooks {
+		if err := hook.run(stateBytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *Hook) run(state []byte) error {
+	timeout := DefaultHookTimeout
+	if h.Timeout != nil {
+		timeout = time.Duration(*h.Timeout) * time.Second
+	}
+
+	cmd := exec.Command(h.Path)
+	if len(h.Args) > 0 {
+		cmd.Args = h.Args
+	}
+	cmd.Env = h.Env
+	if cmd.Env == nil {
+		cmd.Env = []string{}
+	}
+	cmd.Stdin = bytes.NewReader(state)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	// hook在单独的进程组中运行, 超时后连同它启动的子进程一起杀掉, 否则子进程持有输出管道会让Wait一直阻塞
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("hook %s error %v", h.Path, err)
+	}
+	timer := time.AfterFunc(timeout, func() {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	})
+	err := cmd.Wait()
+	// Stop 返回false说明定时器已经触发
+	if !timer.Stop() {
+		return fmt.Errorf("hook %s timed out after %s", h.Path, timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("hook %s error %v: %s", h.Path, err, bytes.TrimSpace(output.Bytes()))
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package container
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRunHooks(t *testing.T) {
+	state := &State{OCIVersion: OCIVersion, ID: "test", Status: "created", Pid: 1}
+	hooks := []Hook{
+		{Path: "/bin/sh", Args: []string{"sh", "-c", `grep -q '"id":"test"'`}},
+	}
+	if err := RunHooks(hooks, state); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := 1
+	hooks = []Hook{
+		{Path: "/bin/sh", Args: []string{"sh", "-c", "sleep 5"}, Timeout: &timeout},
+	}
+	if err := RunHooks(hooks, state); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected timeout error, got %v", err)
+	}
+
+	hooks = []Hook{
+		{Path: "/bin/sh", Args: []string{"sh", "-c", "echo broken >&2; exit 1"}},
+	}
+	if err := RunHooks(hooks, state); err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Fatalf("expected hook output in error, got %v", err)
+	}
+}
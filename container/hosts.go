@@ -0,0 +1,238 @@
+package container
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	HostResolvConf string = "/etc/resolv.conf"
+	HostHosts      string = "/etc/hosts"
+	// systemd-resolved 使用的上游nameserver, /etc/resolv.conf 中只有它的本地stub 127.0.0.53
+	SystemdResolvConf string = "/run/systemd/resolve/resolv.conf"
+)
+
+const systemdResolvedStub = "127.0.0.53"
+
+// 过滤掉宿主机的回环nameserver之后没有可用的nameserver时使用的默认值, 与docker相同, 使用时打印警告
+var DefaultNameservers = []string{"8.8.8.8", "8.8.4.4"}
+
+// 用于传递 --dns, --dns-search, --dns-option 和 --add-host 的结构体
+type DNSConfig struct {
+	Nameservers []string
+	Search      []string
+	Options     []string
+	ExtraHosts  []string // host:ip 格式
+}
+
+// 容器启动前bind到rootfs中的文件或目录, Source 是宿主机上的路径, Destination 是容器内的路径
+type BindMount struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+}
+
+// 检查 --dns 和 --add-host 参数
+func (c *DNSConfig) Validate() error {
+	for _, ns := range c.Nameservers {
+		if net.ParseIP(ns) == nil {
+			return fmt.Errorf("Invalid dns server %s", ns)
+		}
+	}
+	for _, host := range c.ExtraHosts {
+		if _, _, err := parseExtraHost(host); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 解析 host:ip 格式的 --add-host, ip 可以是带冒号的ipv6地址
+func parseExtraHost(extraHost string) (string, string, error) {
+	parts := strings.SplitN(extraHost, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || net.ParseIP(parts[1]) == nil {
+		return "", "", fmt.Errorf("Invalid add-host %s, expected host:ip", extraHost)
+	}
+	return parts[0], parts[1], nil
+}
+
+// 在容器的状态目录中生成 hosts, resolv.conf 和 hostname, 返回需要bind到rootfs中的文件
+// 与宿主机共享网络时 hosts 以宿主机的为基础, resolv.conf 不过滤回环地址, 因为容器可以访问宿主机上的DNS服务
+// uid和gid是容器内root在宿主机上对应的用户, 让容器可以修改这些文件
+func SetupEtcFiles(containerName, hostname, ip string, dns *DNSConfig, hostNetwork bool, uid, gid int) ([]*BindMount, error) {
+	dirURL := fmt.Sprintf(DefaultInfoLocation, containerName)
+	hosts, err := buildHosts(hostname, ip, dns.ExtraHosts, hostNetwork)
+	if err != nil {
+		return nil, err
+	}
+	resolvConf, err := readHostResolvConf(!hostNetwork)
+	if err != nil {
+		return nil, err
+	}
+	files := []struct {
+		name    string
+		content []byte
+	}{
+		{"hosts", hosts},
+		{"resolv.conf", buildResolvConf(resolvConf, dns, !hostNetwork)},
+		{"hostname", []byte(hostname + "\n")},
+	}
+
+	// init进程以映射后的root身份bind这些文件, 需要能够进入容器的状态目录
+	if uid != 0 {
+		if err := MakeTraversable(dirURL); err != nil {
+			return nil, err
+		}
+	}
+	var mounts []*BindMount
+	for _, f := range files {
+		path := dirURL + f.name
+		if err := ioutil.WriteFile(path, f.content, 0644); err != nil {
+			return nil, fmt.Errorf("Write %s error %v", path, err)
+		}
+		if err := os.Chown(path, uid, gid); err != nil {
+			return nil, fmt.Errorf("Chown %s error %v", path, err)
+		}
+		mounts = append(mounts, &BindMount{Source: path, Destination: "/etc/" + f.name})
+	}
+	return mounts, nil
+}
+
+func buildHosts(hostname, ip string, extraHosts []string, hostNetwork bool) ([]byte, error) {
+	var buf bytes.Buffer
+	if hostNetwork {
+		content, err := ioutil.ReadFile(HostHosts)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		buf.Write(content)
+		if len(content) > 0 && content[len(content)-1] != '\n' {
+			buf.WriteByte('\n')
+		}
+	} else {
+		buf.WriteString("127.0.0.1\tlocalhost\n")
+		buf.WriteString("::1\tlocalhost ip6-localhost ip6-loopback\n")
+		buf.WriteString("fe00::0\tip6-localnet\n")
+		buf.WriteString("ff00::0\tip6-mcastprefix\n")
+		buf.WriteString("ff02::1\tip6-allnodes\n")
+		buf.WriteString("ff02::2\tip6-allrouters\n")
+	}
+	for _, extraHost := range extraHosts {
+		host, hostIP, err := parseExtraHost(extraHost)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&buf, "%s\t%s\n", hostIP, host)
+	}
+	if ip != "" {
+		fmt.Fprintf(&buf, "%s\t%s\n", ip, hostname)
+	}
+	return buf.Bytes(), nil
+}
+
+// 读取宿主机的resolv.conf, 不存在时返回空
+// 容器有自己的网络并且其中只有systemd-resolved的stub时, 与docker一致改用systemd-resolved的上游配置
+func readHostResolvConf(filterLoopback bool) ([]byte, error) {
+	resolvConf, err := ioutil.ReadFile(HostResolvConf)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if !filterLoopback || !onlySystemdStub(resolvConf) {
+		return resolvConf, nil
+	}
+	upstream, err := ioutil.ReadFile(SystemdResolvConf)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return resolvConf, nil
+		}
+		return nil, err
+	}
+	return upstream, nil
+}
+
+// resolv.conf 中的nameserver是否只有systemd-resolved的stub
+func onlySystemdStub(resolvConf []byte) bool {
+	found := false
+	scanner := bufio.NewScanner(bytes.NewReader(resolvConf))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+		if fields[1] != systemdResolvedStub {
+			return false
+		}
+		found = true
+	}
+	return found
+}
+
+// 以宿主机的resolv.conf为基础生成容器的resolv.conf
+// --dns, --dns-search 和 --dns-option 分别替换对应的配置
+// 容器有自己的网络时宿主机的127.0.0.0/8和::1在容器内不可达, 需要过滤掉, 全部被过滤时使用默认的nameserver
+func buildResolvConf(hostResolvConf []byte, dns *DNSConfig, filterLoopback bool) []byte {
+	var nameservers, search, options, others []string
+	scanner := bufio.NewScanner(bytes.NewReader(hostResolvConf))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			if len(fields) < 2 {
+				continue
+			}
+			if ip := net.ParseIP(fields[1]); filterLoopback && ip != nil && ip.IsLoopback() {
+				continue
+			}
+			nameservers = append(nameservers, fields[1])
+		case "search", "domain":
+			search = fields[1:]
+		case "options":
+			options = append(options, fields[1:]...)
+		default:
+			others = append(others, line)
+		}
+	}
+
+	if len(dns.Nameservers) > 0 {
+		nameservers = dns.Nameservers
+	}
+	if len(nameservers) == 0 && filterLoopback {
+		log.Warnf("No usable nameserver in host resolv.conf, using default nameservers %s, use --dns to set others", strings.Join(DefaultNameservers, " "))
+		nameservers = DefaultNameservers
+	}
+	if len(dns.Search) > 0 {
+		search = dns.Search
+	}
+	// --dns-search=. 表示不使用search domain
+	if len(search) == 1 && search[0] == "." {
+		search = nil
+	}
+	if len(dns.Options) > 0 {
+		options = dns.Options
+	}
+
+	var buf bytes.Buffer
+	for _, line := range others {
+		buf.WriteString(line + "\n")
+	}
+	if len(search) > 0 {
+		buf.WriteString("search " + strings.Join(search, " ") + "\n")
+	}
+	for _, ns := range nameservers {
+		buf.WriteString("nameserver " + ns + "\n")
+	}
+	if len(options) > 0 {
+		buf.WriteString("options " + strings.Join(options, " ") + "\n")
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,101 @@
+package container
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBuildResolvConf(t *testing.T) {
+	host := []byte("# generated\nnameserver 127.0.0.53\nnameserver 10.0.0.2\nsearch example.com\noptions ndots:2\n")
+
+	conf := string(buildResolvConf(host, &DNSConfig{}, true))
+	if strings.Contains(conf, "127.0.0.53") || !strings.Contains(conf, "nameserver 10.0.0.2\n") {
+		t.Fatalf("loopback nameserver not filtered:\n%s", conf)
+	}
+	if !strings.Contains(conf, "search example.com\n") || !strings.Contains(conf, "options ndots:2\n") {
+		t.Fatalf("search or options lost:\n%s", conf)
+	}
+
+	// 与宿主机共享网络时保留回环地址
+	conf = string(buildResolvConf(host, &DNSConfig{}, false))
+	if !strings.Contains(conf, "nameserver 127.0.0.53\n") {
+		t.Fatalf("loopback nameserver filtered in host network:\n%s", conf)
+	}
+
+	// 只有回环地址时使用默认的nameserver
+	conf = string(buildResolvConf([]byte("nameserver ::1\n"), &DNSConfig{}, true))
+	if conf != "nameserver 8.8.8.8\nnameserver 8.8.4.4\n" {
+		t.Fatalf("unexpected default resolv.conf:\n%s", conf)
+	}
+
+	dns := &DNSConfig{
+		Nameservers: []string{"1.1.1.1"},
+		Search:      []string{"."},
+		Options:     []string{"rotate"},
+	}
+	conf = string(buildResolvConf(host, dns, true))
+	if conf != "nameserver 1.1.1.1\noptions rotate\n" {
+		t.Fatalf("unexpected overridden resolv.conf:\n%s", conf)
+	}
+}
+
+func TestReadHostResolvConf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "paddle-resolv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(host, systemd string) {
+		HostResolvConf, SystemdResolvConf = host, systemd
+	}(HostResolvConf, SystemdResolvConf)
+	HostResolvConf = filepath.Join(dir, "resolv.conf")
+	SystemdResolvConf = filepath.Join(dir, "systemd-resolv.conf")
+	stub := "nameserver 127.0.0.53\noptions edns0 trust-ad\nsearch lan\n"
+	upstream := "nameserver 192.168.1.1\nsearch lan\n"
+	ioutil.WriteFile(HostResolvConf, []byte(stub), 0644)
+
+	// 没有systemd-resolved的上游配置时仍然使用宿主机的
+	conf, err := readHostResolvConf(true)
+	if err != nil || string(conf) != stub {
+		t.Fatalf("unexpected resolv.conf %q: %v", conf, err)
+	}
+
+	// 只有stub时使用systemd-resolved的上游nameserver
+	ioutil.WriteFile(SystemdResolvConf, []byte(upstream), 0644)
+	conf, err = readHostResolvConf(true)
+	if err != nil || string(conf) != upstream {
+		t.Fatalf("systemd-resolved upstream not used: %q: %v", conf, err)
+	}
+
+	// 与宿主机共享网络时stub可以访问
+	conf, err = readHostResolvConf(false)
+	if err != nil || string(conf) != stub {
+		t.Fatalf("unexpected resolv.conf in host network %q: %v", conf, err)
+	}
+
+	// 还有其它nameserver时不替换
+	other := "nameserver 127.0.0.53\nnameserver 10.0.0.2\n"
+	ioutil.WriteFile(HostResolvConf, []byte(other), 0644)
+	conf, err = readHostResolvConf(true)
+	if err != nil || string(conf) != other {
+		t.Fatalf("unexpected resolv.conf %q: %v", conf, err)
+	}
+}
+
+func TestBuildHosts(t *testing.T) {
+	hosts, err := buildHosts("web", "10.0.0.5", []string{"db:10.0.0.6", "v6:fe80::1"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"127.0.0.1\tlocalhost\n", "10.0.0.6\tdb\n", "fe80::1\tv6\n", "10.0.0.5\tweb\n"} {
+		if !strings.Contains(string(hosts), line) {
+			t.Fatalf("missing %q in:\n%s", line, hosts)
+		}
+	}
+	if _, err := buildHosts("web", "", []string{"db"}, false); err == nil {
+		t.Fatal("expected error for invalid add-host")
+	}
+}
@@ -0,0 +1,217 @@
+package container
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sys/unix"
+)
+
+// 把镜像配置和命令行参数合并成容器最终的运行配置
+// 1. 指定了 --entrypoint 时替换镜像的Entrypoint, 同时忽略镜像的Cmd
+// 2. 命令行末尾有参数时替换Cmd
+// 3. 环境变量依次为镜像的Env, --env-file, -e, 同名变量以后面的为准
+// 返回的配置中 Cmd 是完整的命令, Entrypoint 为空
+func MergeImageConfig(image *v1.ImageConfig, entrypoint string, args, env []string) (*v1.ImageConfig, error) {
+	config := *image
+	cmd := image.Cmd
+	if entrypoint != "" {
+		config.Entrypoint = []string{entrypoint}
+		cmd = nil
+	}
+	if len(args) > 0 {
+		cmd = args
+	}
+	config.Cmd = append(append([]string{}, config.Entrypoint...), cmd...)
+	config.Entrypoint = nil
+	if len(config.Cmd) == 0 {
+		return nil, fmt.Errorf("No command specified")
+	}
+	config.Env = MergeEnv(image.Env, env)
+	return &config, nil
+}
+
+// 合并两组 KEY=VALUE 格式的环境变量, overrides 中的同名变量覆盖 base, 保持首次出现的顺序
+func MergeEnv(base, overrides []string) []string {
+	var merged []string
+	index := map[string]int{}
+	for _, kv := range append(append([]string{}, base...), overrides...) {
+		key := strings.SplitN(kv, "=", 2)[0]
+		if i, ok := index[key]; ok {
+			merged[i] = kv
+			continue
+		}
+		index[key] = len(merged)
+		merged = append(merged, kv)
+	}
+	return merged
+}
+
+// 读取 --env-file 指定的文件, 每行一个 KEY=VALUE, 忽略空行和 # 开头的注释
+// 只写了 KEY 的行与docker一致, 从当前环境中取值, 当前环境中没有时忽略
+func ParseEnvFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var env []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimLeft(scanner.Text(), " \t")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if kv[0] == "" || strings.ContainsAny(kv[0], " \t") {
+			return nil, fmt.Errorf("Invalid environment variable %q in %s", line, path)
+		}
+		if len(kv) == 1 {
+			if value, ok := os.LookupEnv(kv[0]); ok {
+				env = append(env, kv[0]+"="+value)
+			}
+			continue
+		}
+		env = append(env, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+// 解析 commit --change 中的一条指令, 语法与Dockerfile相同
+// 支持 ENV, ENTRYPOINT, CMD, WORKDIR, USER, EXPOSE, STOPSIGNAL 和 LABEL
+func ApplyImageChange(config *v1.ImageConfig, change string) error {
+	parts := strings.SplitN(strings.TrimSpace(change), " ", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+		return fmt.Errorf("Invalid change %q", change)
+	}
+	instruction, value := strings.ToUpper(parts[0]), strings.TrimSpace(parts[1])
+	switch instruction {
+	case "ENV":
+		pairs, err := parseKeyValues(value)
+		if err != nil {
+			return fmt.Errorf("Invalid change %q: %v", change, err)
+		}
+		for _, kv := range pairs {
+			config.Env = MergeEnv(config.Env, []string{kv[0] + "=" + kv[1]})
+		}
+	case "LABEL":
+		pairs, err := parseKeyValues(value)
+		if err != nil {
+			return fmt.Errorf("Invalid change %q: %v", change, err)
+		}
+		if config.Labels == nil {
+			config.Labels = map[string]string{}
+		}
+		for _, kv := range pairs {
+			config.Labels[kv[0]] = kv[1]
+		}
+	case "ENTRYPOINT":
+		config.Entrypoint = parseCommand(value)
+	case "CMD":
+		config.Cmd = parseCommand(value)
+	case "WORKDIR":
+		config.WorkingDir = value
+	case "USER":
+		config.User = value
+	case "EXPOSE":
+		if config.ExposedPorts == nil {
+			config.ExposedPorts = map[string]struct{}{}
+		}
+		for _, port := range strings.Fields(value) {
+			if !strings.Contains(port, "/") {
+				port += "/tcp"
+			}
+			if _, err := strconv.ParseUint(strings.SplitN(port, "/", 2)[0], 10, 16); err != nil {
+				return fmt.Errorf("Invalid port %s in change %q", port, change)
+			}
+			config.ExposedPorts[port] = struct{}{}
+		}
+	case "STOPSIGNAL":
+		if _, err := ParseSignal(value); err != nil {
+			return err
+		}
+		config.StopSignal = value
+	default:
+		return fmt.Errorf("Unsupported change instruction %s", parts[0])
+	}
+	return nil
+}
+
+// exec格式 ["a", "b"] 按json解析, 否则与Dockerfile的shell格式相同, 通过 /bin/sh -c 运行
+func parseCommand(value string) []string {
+	var args []string
+	if strings.HasPrefix(value, "[") && json.Unmarshal([]byte(value), &args) == nil {
+		return args
+	}
+	return []string{"/bin/sh", "-c", value}
+}
+
+// 解析 ENV 和 LABEL 的参数, 支持 KEY VALUE 和 KEY1=VALUE1 KEY2="VALUE 2" 两种写法
+func parseKeyValues(value string) ([][2]string, error) {
+	first := strings.Fields(value)[0]
+	if !strings.Contains(first, "=") {
+		kv := strings.SplitN(value, " ", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("missing value for %s", kv[0])
+		}
+		return [][2]string{{kv[0], strings.TrimSpace(kv[1])}}, nil
+	}
+
+	var pairs [][2]string
+	for value != "" {
+		eq := strings.Index(value, "=")
+		if eq <= 0 {
+			return nil, fmt.Errorf("expected KEY=VALUE in %q", value)
+		}
+		key := value[:eq]
+		rest := value[eq+1:]
+		var val string
+		if strings.HasPrefix(rest, "\"") {
+			end := strings.Index(rest[1:], "\"")
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quote in %q", value)
+			}
+			val = rest[1 : end+1]
+			rest = rest[end+2:]
+		} else if sp := strings.IndexAny(rest, " \t"); sp >= 0 {
+			val = rest[:sp]
+			rest = rest[sp:]
+		} else {
+			val = rest
+			rest = ""
+		}
+		pairs = append(pairs, [2]string{key, val})
+		value = strings.TrimLeft(rest, " \t")
+	}
+	return pairs, nil
+}
+
+// 解析信号, 支持 SIGTERM, TERM 和数字三种写法
+func ParseSignal(s string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		if n <= 0 || n > 64 {
+			return 0, fmt.Errorf("Invalid signal %s", s)
+		}
+		return syscall.Signal(n), nil
+	}
+	name := strings.ToUpper(s)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	for i := 1; i < 65; i++ {
+		if unix.SignalName(syscall.Signal(i)) == name {
+			return syscall.Signal(i), nil
+		}
+	}
+	return 0, fmt.Errorf("Invalid signal %s", s)
+}
@@ -0,0 +1,88 @@
+package container
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestMergeImageConfig(t *testing.T) {
+	image := &v1.ImageConfig{
+		Env:        []string{"PATH=/bin", "A=1"},
+		Entrypoint: []string{"/entry"},
+		Cmd:        []string{"serve"},
+	}
+	config, err := MergeImageConfig(image, "", nil, []string{"A=2", "B=3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config.Cmd, []string{"/entry", "serve"}) {
+		t.Fatalf("unexpected cmd %v", config.Cmd)
+	}
+	if !reflect.DeepEqual(config.Env, []string{"PATH=/bin", "A=2", "B=3"}) {
+		t.Fatalf("unexpected env %v", config.Env)
+	}
+
+	config, _ = MergeImageConfig(image, "", []string{"debug"}, nil)
+	if !reflect.DeepEqual(config.Cmd, []string{"/entry", "debug"}) {
+		t.Fatalf("unexpected cmd %v", config.Cmd)
+	}
+
+	// --entrypoint 会丢弃镜像的Cmd
+	config, _ = MergeImageConfig(image, "/bin/sh", nil, nil)
+	if !reflect.DeepEqual(config.Cmd, []string{"/bin/sh"}) {
+		t.Fatalf("unexpected cmd %v", config.Cmd)
+	}
+
+	if _, err := MergeImageConfig(&v1.ImageConfig{}, "", nil, nil); err == nil {
+		t.Fatal("expected error for empty command")
+	}
+}
+
+func TestApplyImageChange(t *testing.T) {
+	config := &v1.ImageConfig{Env: []string{"A=1"}}
+	changes := []string{
+		`ENV A=2 B="x y"`,
+		`ENV C 3 4`,
+		`CMD ["top", "-b"]`,
+		`ENTRYPOINT echo hi`,
+		`WORKDIR /app`,
+		`USER nobody:nogroup`,
+		`EXPOSE 80 53/udp`,
+		`STOPSIGNAL SIGINT`,
+		`LABEL version=1.0`,
+	}
+	for _, change := range changes {
+		if err := ApplyImageChange(config, change); err != nil {
+			t.Fatalf("%s: %v", change, err)
+		}
+	}
+	if !reflect.DeepEqual(config.Env, []string{"A=2", "B=x y", "C=3 4"}) {
+		t.Fatalf("unexpected env %v", config.Env)
+	}
+	if !reflect.DeepEqual(config.Cmd, []string{"top", "-b"}) {
+		t.Fatalf("unexpected cmd %v", config.Cmd)
+	}
+	if !reflect.DeepEqual(config.Entrypoint, []string{"/bin/sh", "-c", "echo hi"}) {
+		t.Fatalf("unexpected entrypoint %v", config.Entrypoint)
+	}
+	if config.WorkingDir != "/app" || config.User != "nobody:nogroup" || config.StopSignal != "SIGINT" {
+		t.Fatalf("unexpected config %+v", config)
+	}
+	if _, ok := config.ExposedPorts["80/tcp"]; !ok {
+		t.Fatalf("unexpected ports %v", config.ExposedPorts)
+	}
+	if _, ok := config.ExposedPorts["53/udp"]; !ok {
+		t.Fatalf("unexpected ports %v", config.ExposedPorts)
+	}
+	if config.Labels["version"] != "1.0" {
+		t.Fatalf("unexpected labels %v", config.Labels)
+	}
+
+	for _, change := range []string{"RUN make", "STOPSIGNAL SIGFOO", "EXPOSE http", "ENV"} {
+		if err := ApplyImageChange(config, change); err == nil {
+			t.Fatalf("expected error for %q", change)
+		}
+	}
+}
@@ -1,27 +1,117 @@
 package container
 
 import (
+	"encoding/json"
 	"path/filepath"
 	"os/exec"
-	"strings"
+	"runtime"
 	"io/ioutil"
 	"fmt"
 	"os"
 	"syscall"
+	"github.com/IsolationWyn/paddle/seccomp"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
 )
 
+// 父进程通过管道传递给容器init进程的配置
+type InitConfig struct {
+	Args            []string          `json:"args"`            // 用户指定的命令及参数
+	Capabilities    []string          `json:"capabilities"`    // 容器进程保留的capability
+	Seccomp         *seccomp.Seccomp  `json:"seccomp"`         // 为nil时不安装seccomp过滤器
+	NoNewPrivileges bool              `json:"noNewPrivileges"` // 设置 PR_SET_NO_NEW_PRIVS
+	ReadonlyRootfs  bool              `json:"readonlyRootfs"`  // 将根目录重新挂载为只读
+	ReadonlyTmpfs   bool              `json:"readonlyTmpfs"`   // 只读根目录下为 /run 和 /tmp 挂载可写的tmpfs
+	MaskedPaths     []string          `json:"maskedPaths"`     // 需要屏蔽的路径
+	ReadonlyPaths   []string          `json:"readonlyPaths"`   // 需要设置为只读的路径
+	Devices         []*Device         `json:"devices"`         // 需要额外创建的设备节点
+	ShmSize         int64             `json:"shmSize"`         // /dev/shm 的大小
+	UserNamespace   bool              `json:"userNamespace"`   // 是否运行在新的user namespace中
+	Console         bool              `json:"console"`         // 标准输入输出是否为pty
+	Cwd             string            `json:"cwd"`             // 用户进程的工作目录
+	User            string            `json:"user"`            // 用户进程使用的 user[:group]
+	Env             []string          `json:"env"`             // 用户进程的全部环境变量, 不继承paddle的环境
+	Hostname        string            `json:"hostname"`        // 容器的主机名, 为空时不修改
+	CgroupNamespace bool              `json:"cgroupNamespace"` // 是否创建私有的cgroup namespace
+	BindMounts      []*BindMount      `json:"bindMounts"`      // bind到rootfs中的文件, 例如 /etc/hosts
+	Sysctls         map[string]string `json:"sysctls"`         // 写入 /proc/sys 的内核参数
+}
+
+// exec同步管道在init进程中的文件描述符, 见 NewParentProcess
+const execSyncFd = 4
+
+// init进程在exec之前失败时把错误写入exec同步管道, 父进程据此判断是否运行poststart
+// exec成功时管道因为close-on-exec被关闭, 父进程读到EOF
 func RunContainerInitProcess() error {
-	cmdArray := readUserCommand()
-	if cmdArray == nil || len(cmdArray) == 0 {
+	syscall.CloseOnExec(execSyncFd)
+	execSync := os.NewFile(uintptr(execSyncFd), "exec-sync")
+	err := runContainerInit()
+	if err != nil {
+		execSync.Write([]byte(err.Error()))
+	}
+	execSync.Close()
+	return err
+}
+
+func runContainerInit() error {
+	// capset等操作只对当前线程生效, 锁定线程保证设置和最后的exec发生在同一个线程上
+	runtime.LockOSThread()
+
+	initConfig := readInitConfig()
+	if initConfig == nil || len(initConfig.Args) == 0 {
 		return fmt.Errorf("Run container get user command error, cmdArray is nil")
 	}
+	cmdArray := initConfig.Args
+	// 父进程在发送配置之前已经把init进程加入容器的cgroup, 此时unshare可以让容器的cgroup成为namespace的根
+	if initConfig.CgroupNamespace {
+		if err := unix.Unshare(unix.CLONE_NEWCGROUP); err != nil {
+			log.Errorf("Unshare cgroup namespace error %v", err)
+			return err
+		}
+	}
 	/*
 	使用mount去挂载proc文件系统, 以便后面通过ps等命令去查看当前进程资源的情况
 	init进程读取了父进程传递过来的参数后, 在子进程内进行了执行, 这样就完成了将用户指定命令传递给子进程的操作
 	*/
 	
-	setUpMount()
+	if initConfig.Hostname != "" {
+		if err := syscall.Sethostname([]byte(initConfig.Hostname)); err != nil {
+			log.Errorf("Set hostname error %v", err)
+			return err
+		}
+	}
+	if err := setUpMount(initConfig); err != nil {
+		return err
+	}
+	if err := writeSysctls(initConfig.Sysctls); err != nil {
+		log.Errorf("Set sysctls error %v", err)
+		return err
+	}
+	// 工作目录不存在时与docker一致自动创建, 需要在根目录变成只读之前进行
+	if initConfig.Cwd != "" {
+		if err := os.MkdirAll(initConfig.Cwd, 0755); err != nil {
+			log.Errorf("Mkdir working dir %s error %v", initConfig.Cwd, err)
+			return err
+		}
+	}
+	if err := finalizeRootfs(initConfig); err != nil {
+		log.Errorf("Finalize rootfs error %v", err)
+		return err
+	}
+
+	execUser, err := GetExecUser("/", initConfig.User)
+	if err != nil {
+		log.Errorf("Get exec user error %v", err)
+		return err
+	}
+	if initConfig.Cwd != "" {
+		if err := syscall.Chdir(initConfig.Cwd); err != nil {
+			log.Errorf("Chdir to %s error %v", initConfig.Cwd, err)
+			return err
+		}
+	}
+
+	setupEnv(initConfig.Env, execUser.Home)
 
 	// 调用exec.LookPath, 可以在系统的PATH里面寻找命令的绝对路径
 	path, err := exec.LookPath(cmdArray[0])
@@ -30,6 +120,10 @@ func RunContainerInitProcess() error {
 		return err
 	} 
 	log.Infof("Find path %s", path)
+
+	if err := setupSecurity(initConfig, execUser); err != nil {
+		return err
+	}
 	if err := syscall.Exec(path, cmdArray[0:], os.Environ()); err != nil {
 		log.Errorf(err.Error())
 		return err
@@ -37,7 +131,75 @@ func RunContainerInitProcess() error {
 	return nil
 }
 
-func readUserCommand() []string {
+// 在exec之前设置no_new_privs, seccomp和capability
+// 没有no_new_privs时安装seccomp过滤器需要CAP_SYS_ADMIN, 所以要在收缩capability之前进行
+// 设置了no_new_privs时则把seccomp放到最后, 尽量减少过滤器需要放行的系统调用
+// 过滤器和capability都会被exec之后的用户进程继承
+// 切换用户放在收缩bounding set之后, capset之前, 这样两步都还有需要的capability
+func setupSecurity(initConfig *InitConfig, execUser *ExecUser) error {
+	// user namespace 中init已经以映射后的root身份运行, 这里再清掉附加组; 拥有的capability只在容器的namespace中有效
+	if initConfig.UserNamespace {
+		if err := switchToContainerRoot(); err != nil {
+			log.Errorf("Switch to container root error %v", err)
+			return err
+		}
+	}
+
+	if initConfig.NoNewPrivileges {
+		if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+			log.Errorf("Set no_new_privs error %v", err)
+			return err
+		}
+	} else {
+		if err := seccomp.InitSeccomp(initConfig.Seccomp, initConfig.Capabilities); err != nil {
+			log.Errorf("Init seccomp error %v", err)
+			return err
+		}
+	}
+
+	// 与runc的顺序一致: 先收缩bounding set, 再保留permitted切换用户, 最后capset
+	// setgroups和setuid需要CAP_SETGID和CAP_SETUID, 必须在capset去掉它们之前进行
+	if err := DropBoundingSet(initConfig.Capabilities); err != nil {
+		log.Errorf("Drop bounding set error %v", err)
+		return err
+	}
+	if err := unix.Prctl(unix.PR_SET_KEEPCAPS, 1, 0, 0, 0); err != nil {
+		log.Errorf("Set keepcaps error %v", err)
+		return err
+	}
+	if err := setupUser(execUser); err != nil {
+		log.Errorf("Set up user error %v", err)
+		return err
+	}
+	if err := unix.Prctl(unix.PR_SET_KEEPCAPS, 0, 0, 0, 0); err != nil {
+		log.Errorf("Clear keepcaps error %v", err)
+		return err
+	}
+	if err := ApplyCapabilities(initConfig.Capabilities); err != nil {
+		log.Errorf("Apply capabilities error %v", err)
+		return err
+	}
+
+	if initConfig.NoNewPrivileges {
+		if err := seccomp.InitSeccomp(initConfig.Seccomp, initConfig.Capabilities); err != nil {
+			log.Errorf("Init seccomp error %v", err)
+			return err
+		}
+	}
+	return nil
+}
+
+func switchToContainerRoot() error {
+	if err := syscall.Setgroups(nil); err != nil {
+		return err
+	}
+	if err := syscall.Setresgid(0, 0, 0); err != nil {
+		return err
+	}
+	return syscall.Setresuid(0, 0, 0)
+}
+
+func readInitConfig() *InitConfig {
 	pipe := os.NewFile(uintptr(3), "pipe")
 	defer pipe.Close()
 	msg, err := ioutil.ReadAll(pipe)
@@ -45,27 +207,61 @@ func readUserCommand() []string {
 		log.Errorf("init read pipe error %v", err)
 		return nil
 	}
-	msgStr := string(msg)
-	return strings.Split(msgStr, " ")
+	var initConfig InitConfig
+	if err := json.Unmarshal(msg, &initConfig); err != nil {
+		log.Errorf("init unmarshal config error %v", err)
+		return nil
+	}
+	return &initConfig
 }
 
 /**
 Init 挂载点
 */
-func setUpMount() {
+func setUpMount(initConfig *InitConfig) error {
 	pwd, err := os.Getwd()
 	if err != nil {
 		log.Errorf("Get current location error %v", err)
-		return
+		return err
 	}
 	log.Infof("Current location is %s", pwd)
-	pivotRoot(pwd)
-
-	//mount proc
+	// systemd 会把根目录设置为 shared, 先改成 private, 避免容器内的挂载传播到宿主机, 同时 pivot_root 也要求非 shared
+	if err := syscall.Mount("", "/", "", syscall.MS_PRIVATE|syscall.MS_REC, ""); err != nil {
+		log.Errorf("Make mount namespace private error %v", err)
+		return err
+	}
+	// 创建设备节点, 挂载 devpts, shm 和 mqueue
+	if err := setUpDev(pwd, initConfig); err != nil {
+		log.Errorf("Set up /dev error %v", err)
+		return err
+	}
+	// 挂载生成的 /etc/hosts, /etc/resolv.conf 和 /etc/hostname
+	if err := bindMounts(pwd, initConfig.BindMounts); err != nil {
+		log.Errorf("Bind mounts error %v", err)
+		return err
+	}
+	// proc 和 sysfs 在 pivotRoot 之前挂载到rootfs中
+	// user namespace 中内核只在当前mount namespace里能看到完整的proc和sysfs时才允许新的挂载, 卸载宿主机的根目录之后就不再满足
 	defaultMountFlags := syscall.MS_NOEXEC | syscall.MS_NOSUID | syscall.MS_NODEV
-	syscall.Mount("proc", "/proc", "proc", uintptr(defaultMountFlags), "")
-
-	syscall.Mount("tmpfs", "/dev", "tmpfs", syscall.MS_NOSUID|syscall.MS_STRICTATIME, "mode=755")
+	if err := os.MkdirAll(pwd+"/proc", 0755); err != nil {
+		log.Errorf("Mkdir /proc error %v", err)
+	}
+	if err := syscall.Mount("proc", pwd+"/proc", "proc", uintptr(defaultMountFlags), ""); err != nil {
+		log.Warnf("Mount /proc error %v", err)
+	}
+	// sysfs 以只读方式挂载, 容器内无法修改宿主机的内核参数和设备
+	if err := os.MkdirAll(pwd+"/sys", 0755); err != nil {
+		log.Errorf("Mkdir /sys error %v", err)
+	}
+	if err := syscall.Mount("sysfs", pwd+"/sys", "sysfs", uintptr(defaultMountFlags|syscall.MS_RDONLY), ""); err != nil {
+		log.Errorf("Mount /sys error %v", err)
+		return err
+	}
+	if err := pivotRoot(pwd); err != nil {
+		log.Errorf("Pivot root error %v", err)
+		return err
+	}
+	return nil
 }
 
 func pivotRoot(root string) error {
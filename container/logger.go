@@ -0,0 +1,99 @@
+package container
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// container.log 中的一行, 与docker的json-file日志格式相同
+type LogEntry struct {
+	Log    string    `json:"log"`
+	Stream string    `json:"stream"`
+	Time   time.Time `json:"time"`
+}
+
+// 为后台容器启动日志进程, 返回交给容器的stdout和stderr管道写端
+// 日志进程读取两个管道, 给每一行打上stream标签之后写入 container.log
+// 它运行在独立的session中, 在容器所有进程关闭管道之后自己退出
+func StartLogger(containerName string) (*os.File, *os.File, error) {
+	stdoutRead, stdoutWrite, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	stderrRead, stderrWrite, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer stdoutRead.Close()
+	defer stderrRead.Close()
+
+	initCmd, err := os.Readlink("/proc/self/exe")
+	if err != nil {
+		return nil, nil, fmt.Errorf("get init process error %v", err)
+	}
+	cmd := exec.Command(initCmd, "logger", containerName)
+	cmd.ExtraFiles = []*os.File{stdoutRead, stderrRead}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return nil, nil, fmt.Errorf("Start logger error %v", err)
+	}
+	// 不等待日志进程, 它的生命周期跟随容器
+	cmd.Process.Release()
+	return stdoutWrite, stderrWrite, nil
+}
+
+// 日志进程的主体, fd 3 是容器的stdout, fd 4 是容器的stderr
+func RunLogger(containerName string) error {
+	logFilePath := fmt.Sprintf(DefaultInfoLocation, containerName) + ContainerLogFile
+	logFile, err := os.OpenFile(logFilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("Open log file %s error %v", logFilePath, err)
+	}
+	defer logFile.Close()
+
+	var mu sync.Mutex
+	encoder := json.NewEncoder(logFile)
+	var wg sync.WaitGroup
+	copyStream := func(r io.Reader, stream string) {
+		defer wg.Done()
+		reader := bufio.NewReader(r)
+		for {
+			line, err := reader.ReadString('\n')
+			if line != "" {
+				mu.Lock()
+				if err := encoder.Encode(&LogEntry{Log: line, Stream: stream, Time: time.Now().UTC()}); err != nil {
+					log.Errorf("Write log error %v", err)
+				}
+				mu.Unlock()
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+	wg.Add(2)
+	go copyStream(os.NewFile(uintptr(3), "stdout"), "stdout")
+	go copyStream(os.NewFile(uintptr(4), "stderr"), "stderr")
+	wg.Wait()
+	return nil
+}
+
+// 为 -d -i 的容器创建stdin的FIFO, 其它命令可以随时向 /var/run/paddle/{{containerName}}/stdin 写入数据
+// 以读写方式打开, 这样容器持有一个写端, 外部写入者来去都不会让容器读到EOF
+func OpenStdinFifo(containerName string) (*os.File, error) {
+	fifoPath := fmt.Sprintf(DefaultInfoLocation, containerName) + ContainerStdinFifo
+	os.Remove(fifoPath)
+	if err := syscall.Mkfifo(fifoPath, 0600); err != nil {
+		return nil, fmt.Errorf("Mkfifo %s error %v", fifoPath, err)
+	}
+	return os.OpenFile(fifoPath, os.O_RDWR, 0)
+}
@@ -0,0 +1,135 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// --pid, --ipc, --uts, --net 的取值, 为空时创建新的namespace
+const (
+	NamespaceHost      = "host"
+	namespaceContainer = "container:"
+)
+
+// 各类namespace对应的clone flag, 同时也是 /proc/<pid>/ns 下的文件名
+var namespaceFlags = map[string]int{
+	"user":   syscall.CLONE_NEWUSER,
+	"cgroup": unix.CLONE_NEWCGROUP,
+	"ipc":    syscall.CLONE_NEWIPC,
+	"uts":    syscall.CLONE_NEWUTS,
+	"net":    syscall.CLONE_NEWNET,
+	"pid":    syscall.CLONE_NEWPID,
+	"mnt":    syscall.CLONE_NEWNS,
+}
+
+// 容器拥有的一个namespace, Path为空时创建新的namespace, 否则加入Path指向的已有namespace
+// 与宿主机共享的namespace不会出现在容器的namespace列表中
+type Namespace struct {
+	Type string `json:"type"`
+	Path string `json:"path,omitempty"`
+}
+
+type Namespaces []Namespace
+
+// 用于传递 --pid, --ipc, --uts, --net 和 --cgroupns 的结构体
+type NamespaceConfig struct {
+	Pid            string
+	Ipc            string
+	Uts            string
+	Net            string
+	PrivateCgroups bool              // 为容器创建私有的cgroup namespace, 容器内只能看到自己的cgroup
+	Pod            string            // 加入pod的net, ipc和uts namespace以及pod的cgroup
+	Sysctls        map[string]string // 在容器拥有的namespace中设置的内核参数
+}
+
+// 解析 host 和 container:<name> 两种取值, 返回是否共享宿主机的namespace以及要加入的容器名
+func ParseNamespaceMode(mode string) (host bool, container string, err error) {
+	switch {
+	case mode == "":
+		return false, "", nil
+	case mode == NamespaceHost:
+		return true, "", nil
+	case strings.HasPrefix(mode, namespaceContainer) && len(mode) > len(namespaceContainer):
+		return false, strings.TrimPrefix(mode, namespaceContainer), nil
+	}
+	return false, "", fmt.Errorf("Invalid namespace mode %s, expected host or container:<name>", mode)
+}
+
+// 某个类型的namespace在 /proc 下的路径
+func NamespacePath(pid, nsType string) string {
+	return fmt.Sprintf("/proc/%s/ns/%s", pid, nsType)
+}
+
+// 返回某个类型的namespace, 与宿主机共享时返回nil
+func (n Namespaces) Get(nsType string) *Namespace {
+	for i := range n {
+		if n[i].Type == nsType {
+			return &n[i]
+		}
+	}
+	return nil
+}
+
+// 需要新建的namespace, 即clone时使用的flag
+// cgroup namespace 以创建时所在的cgroup为根, 所以不在clone时创建, 而是由init进程加入容器的cgroup之后再unshare
+func (n Namespaces) CloneFlags() uintptr {
+	var flags uintptr
+	for _, ns := range n {
+		if ns.Path == "" && ns.Type != "cgroup" {
+			flags |= uintptr(namespaceFlags[ns.Type])
+		}
+	}
+	return flags
+}
+
+// 是否需要加入已有的namespace
+func (n Namespaces) HasJoined() bool {
+	for _, ns := range n {
+		if ns.Path != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// 让当前线程加入Path指向的namespace, 调用者需要先 runtime.LockOSThread
+// 此后由这个线程clone出的进程继承这些namespace, pid namespace 只对子进程生效
+// mnt 和 user namespace 不能在多线程的进程中加入, 所以这里不支持
+func (n Namespaces) Join() error {
+	for _, ns := range n {
+		if ns.Path == "" {
+			continue
+		}
+		if ns.Type == "mnt" || ns.Type == "user" {
+			return fmt.Errorf("Joining an existing %s namespace is not supported", ns.Type)
+		}
+		f, err := os.Open(ns.Path)
+		if err != nil {
+			return fmt.Errorf("Open %s namespace %s error %v", ns.Type, ns.Path, err)
+		}
+		err = unix.Setns(int(f.Fd()), namespaceFlags[ns.Type])
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("Join %s namespace %s error %v", ns.Type, ns.Path, err)
+		}
+	}
+	return nil
+}
+
+// exec时加入容器namespace的顺序, 容器与宿主机共享的namespace不需要加入
+// paddle以宿主机root运行, 可以加入任何namespace, 而加入user namespace之后就失去了对宿主机所属namespace的权限
+// 例如pod中由宿主机user namespace创建的net namespace, 所以user namespace放在最后
+// mnt namespace 放在user之前, 之后的路径解析都发生在容器的文件系统中
+func (n Namespaces) ExecOrder() []string {
+	var order []string
+	for _, nsType := range []string{"ipc", "uts", "net", "pid", "cgroup", "mnt", "user"} {
+		if n.Get(nsType) != nil {
+			order = append(order, nsType)
+		}
+	}
+	return order
+}
@@ -0,0 +1,62 @@
+package container
+
+import (
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestParseNamespaceMode(t *testing.T) {
+	tests := []struct {
+		mode      string
+		host      bool
+		container string
+		valid     bool
+	}{
+		{"", false, "", true},
+		{"host", true, "", true},
+		{"container:web", false, "web", true},
+		{"container:", false, "", false},
+		{"private", false, "", false},
+	}
+	for _, test := range tests {
+		host, container, err := ParseNamespaceMode(test.mode)
+		if (err == nil) != test.valid {
+			t.Fatalf("%q: unexpected error %v", test.mode, err)
+		}
+		if host != test.host || container != test.container {
+			t.Fatalf("%q: got host=%v container=%q", test.mode, host, container)
+		}
+	}
+}
+
+func TestCloneFlags(t *testing.T) {
+	namespaces := Namespaces{
+		{Type: "mnt"},
+		{Type: "uts"},
+		{Type: "net", Path: "/proc/1/ns/net"},
+		{Type: "cgroup"},
+	}
+	if flags := namespaces.CloneFlags(); flags != syscall.CLONE_NEWNS|syscall.CLONE_NEWUTS {
+		t.Fatalf("unexpected clone flags %#x", flags)
+	}
+	if !namespaces.HasJoined() {
+		t.Fatal("expected joined namespace")
+	}
+	if namespaces.Get("pid") != nil || namespaces.Get("net").Path != "/proc/1/ns/net" {
+		t.Fatal("unexpected namespace lookup")
+	}
+}
+
+func TestExecOrder(t *testing.T) {
+	namespaces := Namespaces{
+		{Type: "mnt"},
+		{Type: "user"},
+		{Type: "pid"},
+		{Type: "net", Path: "/proc/1/ns/net"},
+		{Type: "cgroup"},
+	}
+	if order := namespaces.ExecOrder(); !reflect.DeepEqual(order, []string{"net", "pid", "cgroup", "mnt", "user"}) {
+		t.Fatalf("unexpected exec order %v", order)
+	}
+}
@@ -0,0 +1,29 @@
+package container
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+)
+
+// oom_score_adj 的取值范围, -1000 表示OOM killer永远不会选中该进程
+const (
+	OomScoreAdjMin = -1000
+	OomScoreAdjMax = 1000
+)
+
+func ValidateOomScoreAdj(score int) error {
+	if score < OomScoreAdjMin || score > OomScoreAdjMax {
+		return fmt.Errorf("Invalid oom score adj %d, must be in range [%d, %d]", score, OomScoreAdjMin, OomScoreAdjMax)
+	}
+	return nil
+}
+
+// 设置进程的 oom_score_adj, 之后fork出的子进程会继承这个值, pid 为 self 时设置当前进程
+func SetOomScoreAdj(pid string, score int) error {
+	path := fmt.Sprintf("/proc/%s/oom_score_adj", pid)
+	if err := ioutil.WriteFile(path, []byte(strconv.Itoa(score)), 0644); err != nil {
+		return fmt.Errorf("Write %s error %v", path, err)
+	}
+	return nil
+}
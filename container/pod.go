@@ -0,0 +1,83 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+)
+
+var (
+	// /var/run/paddle 下的每个目录都是一个容器, 所以pod的信息单独存放
+	DefaultPodLocation string = "/var/run/paddle-pods/%s/"
+)
+
+// pod的信息, pod由一个pause进程持有net, ipc和uts namespace, 成员容器加入这些namespace和pod的cgroup
+type PodInfo struct {
+	Id          string   `json:"id"`
+	Name        string   `json:"name"`
+	InfraPid    string   `json:"infraPid"` // pause进程在宿主机上的PID
+	Status      string   `json:"status"`   // running 或 stopped
+	CreatedTime string   `json:"createTime"`
+	MemoryLimit string   `json:"memoryLimit"` // pod级别的资源限制, 所有成员容器共享
+	CpuShare    string   `json:"cpuShare"`
+	CpuSet      string   `json:"cpuSet"`
+	Network     string   `json:"network"` // pause进程连接的网络
+	PortMapping []string `json:"portmapping"`
+	IPAddress   string   `json:"ipAddress,omitempty"` // pause进程连接网络之后分配到的IP, 成员容器共享
+}
+
+// pod在各个subsystem中的父cgroup, 成员容器的cgroup创建在它下面
+func PodCgroupPath(podName string) string {
+	return "paddle-pod-" + podName
+}
+
+// 容器在各个subsystem中的cgroup, pod的成员容器创建在pod的cgroup下
+func ContainerCgroupPath(containerName, podName string) string {
+	if podName != "" {
+		return PodCgroupPath(podName) + "/" + containerName
+	}
+	return containerName
+}
+
+// 启动pod的pause进程, 它在新的net, ipc和uts namespace中运行 paddle pause
+func NewPauseProcess(podName string) (*exec.Cmd, error) {
+	initCmd, err := os.Readlink("/proc/self/exe")
+	if err != nil {
+		return nil, fmt.Errorf("get init process error %v", err)
+	}
+	cmd := exec.Command(initCmd, "pause", podName)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWNET | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS,
+		Setsid:     true,
+	}
+	cmd.Env = []string{}
+	cmd.Dir = "/"
+	return cmd, nil
+}
+
+// pause进程的主体: 把主机名设置为pod名, 启动回环网卡, 然后一直等待直到收到SIGTERM或SIGINT
+func RunPause(podName string) error {
+	if err := syscall.Sethostname([]byte(podName)); err != nil {
+		log.Errorf("Set hostname error %v", err)
+		return err
+	}
+	// 新的net namespace中lo默认是关闭的, 没有指定网络时也要启动它, 成员容器之间才能通过localhost通信
+	lo, err := netlink.LinkByName("lo")
+	if err != nil {
+		log.Errorf("Get lo error %v", err)
+		return err
+	}
+	if err := netlink.LinkSetUp(lo); err != nil {
+		log.Errorf("Set lo up error %v", err)
+		return err
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	<-sigs
+	return nil
+}
@@ -0,0 +1,146 @@
+package container
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// 默认屏蔽的路径, 这些文件会泄露宿主机内核信息或者可以直接操作宿主机
+var DefaultMaskedPaths = []string{
+	"/proc/acpi",
+	"/proc/kcore",
+	"/proc/keys",
+	"/proc/latency_stats",
+	"/proc/timer_list",
+	"/proc/timer_stats",
+	"/proc/sched_debug",
+	"/proc/scsi",
+	"/proc/sysrq-trigger",
+	"/sys/firmware",
+	"/sys/devices/virtual/powercap",
+}
+
+// 默认只读的路径
+var DefaultReadonlyPaths = []string{
+	"/proc/bus",
+	"/proc/fs",
+	"/proc/irq",
+	"/proc/sys",
+}
+
+// 屏蔽一个路径: 文件用 /dev/null 覆盖, 目录用只读的空tmpfs覆盖
+func maskPath(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if info.IsDir() {
+		return syscall.Mount("tmpfs", path, "tmpfs", syscall.MS_RDONLY, "")
+	}
+	return syscall.Mount("/dev/null", path, "", syscall.MS_BIND, "")
+}
+
+// 把一个路径bind到自身再重新挂载成只读
+func readonlyPath(path string) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	if err := syscall.Mount(path, path, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return err
+	}
+	return remountReadonly(path)
+}
+
+// 以只读方式重新挂载, 并保留原有的 nosuid, nodev, noexec
+// user namespace 中从父namespace继承的这些标志是被锁定的, 去掉它们会导致 remount 返回 EPERM
+func remountReadonly(path string) error {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return err
+	}
+	flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY)
+	flags |= uintptr(st.Flags) & (syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC)
+	return syscall.Mount("", path, "", flags, "")
+}
+
+// 在 pivotRoot 之前把宿主机上的文件bind到rootfs中, 例如生成的 /etc/hosts 和 paddle debug 的 /target
+// 此时还在宿主机的根目录下, rootfs中的软链接会指向宿主机的文件, 所以目标是软链接时先替换成普通文件或目录
+// 目录以 MS_REC 方式bind, 其下已有的挂载点(例如目标容器的volume)一起可见
+func bindMounts(rootfs string, mounts []*BindMount) error {
+	for _, m := range mounts {
+		source, err := os.Stat(m.Source)
+		if err != nil {
+			return fmt.Errorf("Stat mount source %s error %v", m.Source, err)
+		}
+		target := filepath.Join(rootfs, m.Destination)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if info, err := os.Lstat(target); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			os.Remove(target)
+		}
+		flags := uintptr(syscall.MS_BIND)
+		if source.IsDir() {
+			if err := os.Mkdir(target, 0755); err != nil && !os.IsExist(err) {
+				return fmt.Errorf("Create mount target %s error %v", m.Destination, err)
+			}
+			flags |= syscall.MS_REC
+		} else {
+			f, err := os.OpenFile(target, os.O_CREATE|syscall.O_NOFOLLOW, 0644)
+			if err != nil {
+				return fmt.Errorf("Create mount target %s error %v", m.Destination, err)
+			}
+			f.Close()
+		}
+		if err := syscall.Mount(m.Source, target, "bind", flags, ""); err != nil {
+			return fmt.Errorf("Bind %s to %s error %v", m.Source, m.Destination, err)
+		}
+	}
+	return nil
+}
+
+// 挂载完成之后收紧rootfs: 屏蔽敏感路径, 设置只读路径, 需要时将整个根目录重新挂载为只读
+func finalizeRootfs(initConfig *InitConfig) error {
+	for _, path := range initConfig.ReadonlyPaths {
+		if err := readonlyPath(path); err != nil {
+			return fmt.Errorf("Make %s readonly error %v", path, err)
+		}
+	}
+	for _, path := range initConfig.MaskedPaths {
+		if err := maskPath(path); err != nil {
+			return fmt.Errorf("Mask %s error %v", path, err)
+		}
+	}
+
+	if !initConfig.ReadonlyRootfs {
+		return nil
+	}
+	// 只读根目录下很多程序依然需要可写的 /run 和 /tmp, 挂载点需要在 remount 之前创建好
+	tmpfsPaths := []string{"/run", "/tmp"}
+	if initConfig.ReadonlyTmpfs {
+		for _, path := range tmpfsPaths {
+			if err := os.MkdirAll(path, 0755); err != nil {
+				log.Warnf("Mkdir %s error %v", path, err)
+			}
+		}
+	}
+	// 根目录在 pivotRoot 时已经是一个bind挂载点, 可以直接 remount 成只读
+	if err := remountReadonly("/"); err != nil {
+		return fmt.Errorf("Remount rootfs readonly error %v", err)
+	}
+	if initConfig.ReadonlyTmpfs {
+		for _, path := range tmpfsPaths {
+			if err := syscall.Mount("tmpfs", path, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777"); err != nil {
+				return fmt.Errorf("Mount tmpfs on %s error %v", path, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package container
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// 可以在容器中设置的内核参数, 只有这些参数是按namespace隔离的, 设置时不会影响宿主机
+// key为参数名或以.结尾的前缀, value为参数所属的namespace
+var namespacedSysctls = map[string]string{
+	"kernel.msgmax":          "ipc",
+	"kernel.msgmnb":          "ipc",
+	"kernel.msgmni":          "ipc",
+	"kernel.sem":             "ipc",
+	"kernel.shmall":          "ipc",
+	"kernel.shmmax":          "ipc",
+	"kernel.shmmni":          "ipc",
+	"kernel.shm_rmid_forced": "ipc",
+	"fs.mqueue.":             "ipc",
+	"kernel.domainname":      "uts",
+	"kernel.hostname":        "uts",
+	"net.":                   "net",
+}
+
+// 解析 key=value 格式的 --sysctl
+func ParseSysctls(specs []string) (map[string]string, error) {
+	sysctls := make(map[string]string)
+	for _, spec := range specs {
+		parts := strings.SplitN(spec, "=", 2)
+		key := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || key == "" {
+			return nil, fmt.Errorf("Invalid sysctl %s, expected key=value", spec)
+		}
+		sysctls[key] = parts[1]
+	}
+	return sysctls, nil
+}
+
+// 检查每个参数是否按namespace隔离, 并且容器拥有对应的namespace
+// 与宿主机或其它容器共享的namespace中设置参数会修改它们的配置, 所以同样不允许
+func ValidateSysctls(sysctls map[string]string, namespaces Namespaces) error {
+	for key := range sysctls {
+		nsType := sysctlNamespace(key)
+		if nsType == "" {
+			return fmt.Errorf("sysctl %s is not namespaced and can not be set in a container", key)
+		}
+		if ns := namespaces.Get(nsType); ns == nil || ns.Path != "" {
+			return fmt.Errorf("sysctl %s requires a private %s namespace", key, nsType)
+		}
+	}
+	return nil
+}
+
+func sysctlNamespace(key string) string {
+	if strings.Contains(key, "/") || strings.Contains(key, "..") {
+		return ""
+	}
+	if nsType, ok := namespacedSysctls[key]; ok {
+		return nsType
+	}
+	for prefix, nsType := range namespacedSysctls {
+		if strings.HasSuffix(prefix, ".") && strings.HasPrefix(key, prefix) {
+			return nsType
+		}
+	}
+	return ""
+}
+
+// 在容器的 /proc/sys 下写入内核参数, 需要在 /proc/sys 被设置为只读之前进行
+func writeSysctls(sysctls map[string]string) error {
+	for key, value := range sysctls {
+		path := filepath.Join("/proc/sys", strings.Replace(key, ".", "/", -1))
+		if err := ioutil.WriteFile(path, []byte(value), 0644); err != nil {
+			return fmt.Errorf("Write sysctl %s error %v", key, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package container
+
+import "testing"
+
+func TestValidateSysctls(t *testing.T) {
+	namespaces := Namespaces{{Type: "mnt"}, {Type: "net"}, {Type: "ipc", Path: "/proc/1/ns/ipc"}}
+	tests := []struct {
+		key string
+		ok  bool
+	}{
+		{"net.ipv4.ip_forward", true},
+		{"net.core.somaxconn", true},
+		{"kernel.shmmax", false},   // ipc namespace 来自其它容器
+		{"kernel.hostname", false}, // 与宿主机共享uts namespace
+		{"kernel.pid_max", false},
+		{"vm.swappiness", false},
+		{"net/../../kernel/pid_max", false},
+	}
+	for _, test := range tests {
+		err := ValidateSysctls(map[string]string{test.key: "1"}, namespaces)
+		if (err == nil) != test.ok {
+			t.Errorf("sysctl %s: expected ok=%v, got %v", test.key, test.ok, err)
+		}
+	}
+
+	if _, err := ParseSysctls([]string{"net.core.somaxconn"}); err == nil {
+		t.Fatal("expected error for sysctl without value")
+	}
+}
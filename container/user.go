@@ -0,0 +1,147 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// 容器进程运行使用的用户
+type ExecUser struct {
+	Uid   int
+	Gid   int
+	Sgids []int  // 附加组
+	Home  string // passwd 中的home目录
+}
+
+// 在容器的 /etc/passwd 和 /etc/group 中解析 user[:group] 格式的用户, user和group都可以是名字或数字
+// rootfs 是容器的根目录, init进程在 pivotRoot 之后传入 /, exec 在宿主机上传入 /proc/<pid>/root
+// 数字形式的uid在passwd中不存在时也允许使用, 此时gid默认为0
+func GetExecUser(rootfs, spec string) (*ExecUser, error) {
+	execUser := &ExecUser{Home: "/"}
+	if spec == "" {
+		spec = "0"
+	}
+	parts := strings.SplitN(spec, ":", 2)
+	userArg := parts[0]
+	uidArg, uidErr := strconv.Atoi(userArg)
+
+	found := false
+	// 没有passwd文件时只能使用数字形式的用户
+	passwd, _ := readColonFile(rootfs, "/etc/passwd", 7)
+	for _, entry := range passwd {
+		uid, _ := strconv.Atoi(entry[2])
+		if entry[0] == userArg || uidErr == nil && uid == uidArg {
+			execUser.Uid = uid
+			execUser.Gid, _ = strconv.Atoi(entry[3])
+			execUser.Home = entry[5]
+			found = true
+			break
+		}
+	}
+	if !found {
+		if uidErr != nil {
+			return nil, fmt.Errorf("Unable to find user %s: no matching entries in passwd file", userArg)
+		}
+		if uidArg < 0 {
+			return nil, fmt.Errorf("Invalid uid %d", uidArg)
+		}
+		execUser.Uid = uidArg
+	}
+
+	groups, _ := readColonFile(rootfs, "/etc/group", 4)
+	if len(parts) == 2 {
+		groupArg := parts[1]
+		gidArg, gidErr := strconv.Atoi(groupArg)
+		found = false
+		for _, entry := range groups {
+			gid, _ := strconv.Atoi(entry[2])
+			if entry[0] == groupArg || gidErr == nil && gid == gidArg {
+				execUser.Gid = gid
+				found = true
+				break
+			}
+		}
+		if !found {
+			if gidErr != nil {
+				return nil, fmt.Errorf("Unable to find group %s: no matching entries in group file", groupArg)
+			}
+			execUser.Gid = gidArg
+		}
+		return execUser, nil
+	}
+
+	// 没有指定组时, 和login一样加入group文件中包含该用户的附加组
+	if found {
+		name := userArg
+		for _, entry := range passwd {
+			if uid, _ := strconv.Atoi(entry[2]); uid == execUser.Uid {
+				name = entry[0]
+				break
+			}
+		}
+		for _, entry := range groups {
+			for _, member := range strings.Split(entry[3], ",") {
+				if member == name {
+					gid, _ := strconv.Atoi(entry[2])
+					execUser.Sgids = append(execUser.Sgids, gid)
+				}
+			}
+		}
+	}
+	return execUser, nil
+}
+
+// 读取passwd和group这类以冒号分隔的文件, 字段不足的行补空
+// 路径中的软链接在宿主机上会指向宿主机的文件, 所以遇到软链接时当作文件不存在
+func readColonFile(rootfs, path string, fields int) ([][]string, error) {
+	current := rootfs
+	for _, part := range strings.Split(strings.Trim(path, "/"), "/") {
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if err != nil {
+			return nil, err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return nil, fmt.Errorf("%s is a symlink", path)
+		}
+	}
+	f, err := os.Open(current)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries [][]string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entry := strings.Split(line, ":")
+		for len(entry) < fields {
+			entry = append(entry, "")
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// 切换到指定的用户, 从root切换到非root时内核会清空effective的capability, 没有设置 PR_SET_KEEPCAPS 时permitted也会被清空
+func setupUser(execUser *ExecUser) error {
+	if err := syscall.Setgroups(execUser.Sgids); err != nil {
+		return fmt.Errorf("Setgroups error %v", err)
+	}
+	if err := syscall.Setresgid(execUser.Gid, execUser.Gid, execUser.Gid); err != nil {
+		return fmt.Errorf("Setgid %d error %v", execUser.Gid, err)
+	}
+	if err := syscall.Setresuid(execUser.Uid, execUser.Uid, execUser.Uid); err != nil {
+		return fmt.Errorf("Setuid %d error %v", execUser.Uid, err)
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package container
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/IsolationWyn/paddle/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	SubuidFile string = "/etc/subuid"
+	SubgidFile string = "/etc/subgid"
+)
+
+// user namespace 中没有映射的uid/gid显示为这个值, 即 /proc/sys/kernel/overflowuid 的默认值
+const OverflowID = 65534
+
+// 容器内的uid/gid到宿主机uid/gid的映射, 写入 /proc/<pid>/uid_map 和 gid_map
+type IDMappings struct {
+	UidMappings []syscall.SysProcIDMap `json:"uidMappings"`
+	GidMappings []syscall.SysProcIDMap `json:"gidMappings"`
+}
+
+// 根据 --userns-remap 指定的用户, 从 /etc/subuid 和 /etc/subgid 中读取分配给该用户的范围
+// 容器内的 0 映射到范围的起点, 整个范围依次映射
+func NewIDMappings(remapUser string) (*IDMappings, error) {
+	names := []string{remapUser}
+	if u, err := user.Lookup(remapUser); err == nil {
+		names = append(names, u.Uid)
+	} else if u, err := user.LookupId(remapUser); err == nil {
+		names = append(names, u.Username)
+	}
+
+	uidRanges, err := parseSubIDFile(SubuidFile, names)
+	if err != nil {
+		return nil, err
+	}
+	gidRanges, err := parseSubIDFile(SubgidFile, names)
+	if err != nil {
+		return nil, err
+	}
+	return &IDMappings{
+		UidMappings: toIDMap(uidRanges),
+		GidMappings: toIDMap(gidRanges),
+	}, nil
+}
+
+// 解析 name:start:count 格式的文件, 返回属于names的所有范围
+func parseSubIDFile(path string, names []string) ([][2]int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Open %s error %v", path, err)
+	}
+	defer f.Close()
+
+	var ranges [][2]int
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Split(line, ":")
+		if len(parts) != 3 || !inStrings(names, parts[0]) {
+			continue
+		}
+		start, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid start in %s: %s", path, line)
+		}
+		count, err := strconv.Atoi(parts[2])
+		if err != nil || count <= 0 {
+			return nil, fmt.Errorf("Invalid count in %s: %s", path, line)
+		}
+		ranges = append(ranges, [2]int{start, count})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("No subordinate ids for %s in %s", names[0], path)
+	}
+	return ranges, nil
+}
+
+func toIDMap(ranges [][2]int) []syscall.SysProcIDMap {
+	var idMap []syscall.SysProcIDMap
+	containerID := 0
+	for _, r := range ranges {
+		idMap = append(idMap, syscall.SysProcIDMap{
+			ContainerID: containerID,
+			HostID:      r[0],
+			Size:        r[1],
+		})
+		containerID += r[1]
+	}
+	return idMap
+}
+
+func inStrings(slice []string, s string) bool {
+	for _, item := range slice {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func toHost(idMap []syscall.SysProcIDMap, id int) (int, error) {
+	for _, m := range idMap {
+		if id >= m.ContainerID && id < m.ContainerID+m.Size {
+			return m.HostID + id - m.ContainerID, nil
+		}
+	}
+	return -1, fmt.Errorf("Container id %d is not mapped", id)
+}
+
+// 把容器内的uid/gid转换成宿主机上的uid/gid
+func (m *IDMappings) ToHost(uid, gid int) (int, int, error) {
+	hostUid, err := toHost(m.UidMappings, uid)
+	if err != nil {
+		return -1, -1, err
+	}
+	hostGid, err := toHost(m.GidMappings, gid)
+	if err != nil {
+		return -1, -1, err
+	}
+	return hostUid, hostGid, nil
+}
+
+func toContainer(idMap []syscall.SysProcIDMap, id int) int {
+	for _, m := range idMap {
+		if id >= m.HostID && id < m.HostID+m.Size {
+			return m.ContainerID + id - m.HostID
+		}
+	}
+	return OverflowID
+}
+
+// 把宿主机上的uid/gid还原成容器内的uid/gid
+// 没有映射的id在容器内显示为 nobody, 与内核的 overflowuid 一致
+func (m *IDMappings) ToContainer(uid, gid int) (int, int) {
+	return toContainer(m.UidMappings, uid), toContainer(m.GidMappings, gid)
+}
+
+// 容器内root在宿主机上对应的uid/gid
+func (m *IDMappings) RootPair() (int, int) {
+	uid, gid, _ := m.ToHost(0, 0)
+	return uid, gid
+}
+
+// 映射后的root在宿主机上是一个普通用户, 需要能够穿过path及其各级父目录
+// 与docker的userns-remap一样, 只给缺少执行权限的目录加上其他人的x权限, 不开放读权限
+func MakeTraversable(path string) error {
+	for dir := filepath.Clean(path); ; dir = filepath.Dir(dir) {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		if info.Mode()&0001 == 0 {
+			if err := os.Chmod(dir, info.Mode()|0001); err != nil {
+				return err
+			}
+		}
+		if dir == "/" {
+			return nil
+		}
+	}
+}
+
+// 同一个映射下的镜像只读层id, 例如 <chain id>-100000.100000
+func remappedLayerName(imageLayer string, mappings *IDMappings) string {
+	uid, gid := mappings.RootPair()
+	return fmt.Sprintf("%s-%d.%d", imageLayer, uid, gid)
+}
+
+// 为某个映射准备一份属主平移过的只读层, 返回它的id
+// overlay不支持idmapped mount, 所以和docker的userns-remap一样, 为每个映射保存一份chown过的拷贝, 同一映射的容器共享这一份
+// 镜像的每个层只保存自身的变化, 所以先在最上层之上挂载一个临时层, 从合并之后的rootfs中拷贝
+func CreateRemappedLayer(driver storage.Driver, imageLayer string, mappings *IDMappings) (string, error) {
+	remappedName := remappedLayerName(imageLayer, mappings)
+	if driver.Exists(remappedName) {
+		return remappedName, nil
+	}
+	tmpLayer := remappedName + ".tmp"
+	mntURL := driver.Dir(imageLayer) + ".remap.mnt"
+	driver.Remove(tmpLayer)
+	if err := driver.CreateReadWrite(tmpLayer, imageLayer); err != nil {
+		return "", err
+	}
+	defer driver.Remove(tmpLayer)
+	if err := os.MkdirAll(mntURL, 0755); err != nil {
+		return "", err
+	}
+	defer os.Remove(mntURL)
+	if err := driver.Mount(tmpLayer, mntURL); err != nil {
+		return "", err
+	}
+	defer driver.Unmount(mntURL)
+
+	// 先拷贝到临时目录, 拷贝的同时平移属主, 完成之后再创建层并改名, 避免中途失败留下一份属主错误的层
+	tmpURL := driver.Dir(imageLayer) + ".remap.tmp"
+	os.RemoveAll(tmpURL)
+	defer os.RemoveAll(tmpURL)
+	if err := storage.CopyTree(mntURL, tmpURL, mappings.ToHost); err != nil {
+		log.Errorf("Copy layer %s to %s error %v", mntURL, tmpURL, err)
+		return "", err
+	}
+	if err := driver.Create(remappedName, ""); err != nil {
+		return "", err
+	}
+	dstURL := driver.Dir(remappedName)
+	if err := os.Remove(dstURL); err != nil {
+		driver.Remove(remappedName)
+		return "", err
+	}
+	if err := os.Rename(tmpURL, dstURL); err != nil {
+		driver.Remove(remappedName)
+		return "", err
+	}
+	return remappedName, nil
+}
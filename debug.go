@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/IsolationWyn/paddle/cgroups/subsystems"
+	"github.com/IsolationWyn/paddle/container"
+	"github.com/IsolationWyn/paddle/image"
+	"github.com/IsolationWyn/paddle/storage"
+)
+
+// paddle debug 默认使用的工具镜像
+const DefaultDebugImage = "busybox"
+
+// 容器内挂载目标容器根目录的位置
+const DebugTargetPath = "/target"
+
+// 用工具镜像启动一个临时容器, 加入目标容器的pid, net和ipc namespace, 退出后自动删除
+// 目标容器的rootfs挂载在宿主机的 MntUrl 下, bind到临时容器的 /target, 在这里修改会直接影响目标容器
+func debugContainer(targetName, imageName string, cmdArray []string) error {
+	targetInfo, err := getContainerInfoByName(targetName)
+	if err != nil {
+		return fmt.Errorf("Get container %s info error %v", targetName, err)
+	}
+	if targetInfo.Status != container.RUNNING {
+		return fmt.Errorf("Container %s is not running", targetName)
+	}
+
+	img, err := image.NewStore(image.DefaultRoot).Get(imageName)
+	if err != nil {
+		return fmt.Errorf("Load config of image %s error %v", imageName, err)
+	}
+	config, err := container.MergeImageConfig(&img.Config.Config, "", cmdArray, nil)
+	if err != nil {
+		return err
+	}
+	// 工具镜像通常没有设置命令, 默认进入shell
+	if len(config.Cmd) == 0 {
+		config.Cmd = []string{"sh"}
+	}
+
+	// 调试需要strace, gdb之类的工具, 在默认集合之外加上 CAP_SYS_PTRACE
+	secConf := &container.SecurityConfig{
+		CapAdd: []string{"SYS_PTRACE"},
+	}
+	devConf := &container.DeviceConfig{
+		ShmSize: container.DefaultShmSize,
+	}
+	daemonConfig, err := container.LoadDaemonConfig()
+	if err != nil {
+		return err
+	}
+	driver, err := storage.New(daemonConfig.StorageDriver)
+	if err != nil {
+		return err
+	}
+
+	target := "container:" + targetName
+	nsConf := &container.NamespaceConfig{
+		Pid: target,
+		Ipc: target,
+		Net: target,
+	}
+	mounts := []*container.BindMount{{
+		Source:      fmt.Sprintf(container.MntUrl, targetName),
+		Destination: DebugTargetPath,
+	}}
+	containerName := fmt.Sprintf("%s-debug-%s", targetName, randStringBytes(4))
+
+	// 加载镜像和配置期间目标容器可能已经退出, 启动前再确认一次它的namespace还在
+	if err := checkDebugTarget(targetName); err != nil {
+		return err
+	}
+
+	// 以 -ti 方式在前台运行, 退出后 Run 会删除容器信息和工作目录
+	return Run(true, false, config, &subsystems.ResourceConfig{}, secConf, devConf, &daemonConfig.Hooks, nsConf, &container.DNSConfig{}, mounts, driver, containerName, img, "", "", nil)
+}
+
+// 确认目标容器仍在运行, 并且要加入的pid, net和ipc namespace都还存在
+func checkDebugTarget(targetName string) error {
+	targetInfo, err := getContainerInfoByName(targetName)
+	if err != nil {
+		return fmt.Errorf("Get container %s info error %v", targetName, err)
+	}
+	if targetInfo.Status != container.RUNNING {
+		return fmt.Errorf("Container %s is not running", targetName)
+	}
+	for _, nsType := range []string{"pid", "net", "ipc"} {
+		if _, err := os.Stat(container.NamespacePath(targetInfo.Pid, nsType)); err != nil {
+			return fmt.Errorf("Container %s has exited, %s namespace is gone: %v", targetName, nsType, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/IsolationWyn/paddle/container"
+	log "github.com/sirupsen/logrus"
+)
+
+// 列出容器中所有的exec会话, 包括已经结束的, 用于审计在容器中运行过的命令
+func listExecSessions(containerName string) error {
+	if _, err := getContainerInfoByName(containerName); err != nil {
+		return fmt.Errorf("Get container %s info error %v", containerName, err)
+	}
+	sessions, err := container.ListExecSessions(containerName)
+	if err != nil {
+		return fmt.Errorf("List exec sessions of %s error %v", containerName, err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+	fmt.Fprint(w, "ID\tPID\tUSER\tCOMMAND\tSTATUS\tEXIT CODE\tSTARTED\tENDED\n")
+	for _, session := range sessions {
+		status := session.Status()
+		exitCode := ""
+		if status.Status == container.ExecExited {
+			exitCode = fmt.Sprintf("%d", status.ExitCode)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			session.Id,
+			status.Pid,
+			session.User,
+			strings.Join(session.Command, " "),
+			status.Status,
+			exitCode,
+			session.StartTime,
+			status.EndTime)
+	}
+	if err := w.Flush(); err != nil {
+		log.Errorf("Flush error %v", err)
+	}
+	return nil
+}
+
+// 向exec会话中的命令发送信号, 默认为SIGKILL
+func killExecSession(id, sig string) error {
+	signal := syscall.SIGKILL
+	if sig != "" {
+		var err error
+		if signal, err = container.ParseSignal(sig); err != nil {
+			return err
+		}
+	}
+	session, err := container.FindExecSession(id)
+	if err != nil {
+		return err
+	}
+	status := session.Status()
+	if status.Status != container.ExecRunning || status.Pid == 0 {
+		return fmt.Errorf("Exec session %s is not running", id)
+	}
+	if err := syscall.Kill(status.Pid, signal); err != nil {
+		return fmt.Errorf("Kill exec session %s error %v", id, err)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// 旧版本的镜像是 /root/<name>.tar 中的完整rootfs, 运行配置保存在 /root/<name>.json
+var LegacyRoot string = "/root"
+
+func legacyTarPath(name string) string {
+	return LegacyRoot + "/" + name + ".tar"
+}
+
+func legacyConfigPath(name string) string {
+	return LegacyRoot + "/" + name + ".json"
+}
+
+// 把旧版本的镜像导入为只有一个层的镜像, 第一次使用时自动进行
+func (s *Store) importLegacy(name string) (*Image, error) {
+	config := v1.ImageConfig{}
+	content, err := ioutil.ReadFile(legacyConfigPath(name))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(content, &config); err != nil {
+			return nil, fmt.Errorf("Unmarshal image config %s error %v", name, err)
+		}
+	}
+	return s.Commit(name, nil, legacyTarPath(name), config, "paddle import "+legacyTarPath(name))
+}
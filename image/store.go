@@ -0,0 +1,393 @@
+package image
+
+import (
+	"bytes"
+	_ "crypto/sha256" // go-digest 需要注册sha256
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/IsolationWyn/paddle/archive"
+	"github.com/IsolationWyn/paddle/storage"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// 镜像存储的根目录, 可以在全局配置的 image-root 中修改
+var DefaultRoot string = "/var/lib/paddle/image"
+
+// 镜像存储的布局与OCI image layout相同:
+// blobs/sha256/<hex> 保存层的tar包, 镜像配置和manifest, 内容相同的层只保存一份
+// index.json 记录每个镜像名对应的manifest, 镜像名保存在 org.opencontainers.image.ref.name 中
+// 层按chain id解压到存储驱动中, 有相同父层的镜像共享这些层
+type Store struct {
+	root string
+}
+
+// 一个镜像, Digest 是manifest的digest
+type Image struct {
+	Name     string
+	Digest   digest.Digest
+	Manifest v1.Manifest
+	Config   v1.Image
+}
+
+func NewStore(root string) *Store {
+	return &Store{root: root}
+}
+
+func (s *Store) blobPath(d digest.Digest) string {
+	return filepath.Join(s.root, "blobs", d.Algorithm().String(), d.Hex())
+}
+
+func (s *Store) indexPath() string {
+	return filepath.Join(s.root, "index.json")
+}
+
+func (s *Store) loadIndex() (*v1.Index, error) {
+	index := &v1.Index{Versioned: specs.Versioned{SchemaVersion: 2}}
+	content, err := ioutil.ReadFile(s.indexPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return index, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(content, index); err != nil {
+		return nil, fmt.Errorf("Unmarshal %s error %v", s.indexPath(), err)
+	}
+	return index, nil
+}
+
+func (s *Store) saveIndex(index *v1.Index) error {
+	jsonBytes, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.indexPath(), jsonBytes)
+}
+
+// 把内容写入blobs, 返回它的digest和大小, 已经存在的blob不会重复写入
+func (s *Store) writeBlob(r io.Reader) (digest.Digest, int64, error) {
+	tmpDir := filepath.Join(s.root, "tmp")
+	if err := os.MkdirAll(tmpDir, 0700); err != nil {
+		return "", 0, err
+	}
+	tmp, err := ioutil.TempFile(tmpDir, "blob")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	digester := digest.Canonical.Digester()
+	size, err := io.Copy(io.MultiWriter(tmp, digester.Hash()), r)
+	if err != nil {
+		return "", 0, err
+	}
+	if err := tmp.Sync(); err != nil {
+		return "", 0, err
+	}
+	d := digester.Digest()
+	blob := s.blobPath(d)
+	if _, err := os.Stat(blob); err == nil {
+		return d, size, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(blob), 0755); err != nil {
+		return "", 0, err
+	}
+	if err := os.Rename(tmp.Name(), blob); err != nil {
+		return "", 0, err
+	}
+	return d, size, nil
+}
+
+func (s *Store) writeJSON(v interface{}) (digest.Digest, int64, error) {
+	jsonBytes, err := json.Marshal(v)
+	if err != nil {
+		return "", 0, err
+	}
+	return s.writeBlob(bytes.NewReader(jsonBytes))
+}
+
+func (s *Store) readJSON(d digest.Digest, v interface{}) error {
+	content, err := ioutil.ReadFile(s.blobPath(d))
+	if err != nil {
+		return err
+	}
+	// 读取时校验内容, 防止blob被篡改
+	if digest.FromBytes(content) != d {
+		return fmt.Errorf("Blob %s is corrupted", d)
+	}
+	return json.Unmarshal(content, v)
+}
+
+// 根据镜像名找到镜像, 存储中没有时尝试导入旧格式的 /root/<name>.tar
+func (s *Store) Get(name string) (*Image, error) {
+	index, err := s.loadIndex()
+	if err != nil {
+		return nil, err
+	}
+	for _, desc := range index.Manifests {
+		if desc.Annotations[v1.AnnotationRefName] == name {
+			return s.load(name, desc.Digest)
+		}
+	}
+	if _, err := os.Stat(legacyTarPath(name)); err == nil {
+		return s.importLegacy(name)
+	}
+	return nil, fmt.Errorf("No such image %s", name)
+}
+
+// 根据manifest的digest找到镜像, 不受镜像名之后被重新指向的影响, name只用于显示
+func (s *Store) GetByDigest(name string, d digest.Digest) (*Image, error) {
+	if err := d.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid image digest %s: %v", d, err)
+	}
+	return s.load(name, d)
+}
+
+func (s *Store) load(name string, d digest.Digest) (*Image, error) {
+	img := &Image{Name: name, Digest: d}
+	if err := s.readJSON(d, &img.Manifest); err != nil {
+		return nil, fmt.Errorf("Read manifest of %s error %v", name, err)
+	}
+	if err := s.readJSON(img.Manifest.Config.Digest, &img.Config); err != nil {
+		return nil, fmt.Errorf("Read config of %s error %v", name, err)
+	}
+	if len(img.Config.RootFS.DiffIDs) != len(img.Manifest.Layers) {
+		return nil, fmt.Errorf("Image %s has %d layers but %d diff ids", name, len(img.Manifest.Layers), len(img.Config.RootFS.DiffIDs))
+	}
+	return img, nil
+}
+
+// 所有镜像, 按镜像名排列在index中的顺序
+func (s *Store) List() ([]*Image, error) {
+	index, err := s.loadIndex()
+	if err != nil {
+		return nil, err
+	}
+	var images []*Image
+	for _, desc := range index.Manifests {
+		img, err := s.load(desc.Annotations[v1.AnnotationRefName], desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, img)
+	}
+	return images, nil
+}
+
+// 在parent的基础上加一个层生成新的镜像, parent为nil时生成只有一个层的镜像
+// layerPath 是OCI格式的层tar包, 可以是gzip压缩的
+func (s *Store) Commit(name string, parent *Image, layerPath string, config v1.ImageConfig, createdBy string) (*Image, error) {
+	diffID, err := diffID(layerPath)
+	if err != nil {
+		return nil, fmt.Errorf("Compute diff id of %s error %v", layerPath, err)
+	}
+	mediaType := v1.MediaTypeImageLayer
+	if compressed, err := archive.IsGzip(layerPath); err != nil {
+		return nil, err
+	} else if compressed {
+		mediaType = v1.MediaTypeImageLayerGzip
+	}
+	f, err := os.Open(layerPath)
+	if err != nil {
+		return nil, err
+	}
+	layerDigest, layerSize, err := s.writeBlob(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("Write layer blob error %v", err)
+	}
+
+	now := time.Now().UTC()
+	imageConfig := v1.Image{
+		Architecture: runtime.GOARCH,
+		OS:           runtime.GOOS,
+		RootFS:       v1.RootFS{Type: "layers"},
+	}
+	manifest := v1.Manifest{Versioned: specs.Versioned{SchemaVersion: 2}}
+	if parent != nil {
+		imageConfig = parent.Config
+		imageConfig.RootFS.DiffIDs = append([]digest.Digest{}, parent.Config.RootFS.DiffIDs...)
+		imageConfig.History = append([]v1.History{}, parent.Config.History...)
+		manifest.Layers = append(manifest.Layers, parent.Manifest.Layers...)
+	}
+	imageConfig.Created = &now
+	imageConfig.Config = config
+	imageConfig.RootFS.DiffIDs = append(imageConfig.RootFS.DiffIDs, diffID)
+	imageConfig.History = append(imageConfig.History, v1.History{Created: &now, CreatedBy: createdBy})
+	manifest.Layers = append(manifest.Layers, v1.Descriptor{
+		MediaType: mediaType,
+		Digest:    layerDigest,
+		Size:      layerSize,
+	})
+
+	configDigest, configSize, err := s.writeJSON(imageConfig)
+	if err != nil {
+		return nil, fmt.Errorf("Write config blob error %v", err)
+	}
+	manifest.Config = v1.Descriptor{
+		MediaType: v1.MediaTypeImageConfig,
+		Digest:    configDigest,
+		Size:      configSize,
+	}
+	manifestDigest, manifestSize, err := s.writeJSON(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("Write manifest blob error %v", err)
+	}
+	if err := s.tag(name, v1.Descriptor{
+		MediaType: v1.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      manifestSize,
+	}); err != nil {
+		return nil, err
+	}
+	return &Image{Name: name, Digest: manifestDigest, Manifest: manifest, Config: imageConfig}, nil
+}
+
+// 让镜像名指向新的manifest, 原来的manifest和层依然保留, 可能被其它镜像使用
+func (s *Store) tag(name string, desc v1.Descriptor) error {
+	index, err := s.loadIndex()
+	if err != nil {
+		return err
+	}
+	var manifests []v1.Descriptor
+	for _, m := range index.Manifests {
+		if m.Annotations[v1.AnnotationRefName] != name {
+			manifests = append(manifests, m)
+		}
+	}
+	desc.Annotations = map[string]string{v1.AnnotationRefName: name}
+	index.Manifests = append(manifests, desc)
+	return s.saveIndex(index)
+}
+
+// 每个层的chain id, 也是层在存储驱动中的id
+// 基础层的chain id是它的diff id, 其余层为 sha256(父层的chain id + " " + diff id)
+// 同一个层只有在父层都相同时才会被共享
+func (img *Image) ChainIDs() []digest.Digest {
+	var chainIDs []digest.Digest
+	for i, diffID := range img.Config.RootFS.DiffIDs {
+		if i == 0 {
+			chainIDs = append(chainIDs, diffID)
+			continue
+		}
+		chainIDs = append(chainIDs, digest.FromString(chainIDs[i-1].String()+" "+diffID.String()))
+	}
+	return chainIDs
+}
+
+// 按顺序把镜像的每个层解压到存储驱动中, 已经解压过的层直接复用, 返回最上层的id
+func (s *Store) Unpack(driver storage.Driver, img *Image) (string, error) {
+	if len(img.Manifest.Layers) == 0 {
+		return "", fmt.Errorf("Image %s has no layers", img.Name)
+	}
+	parent := ""
+	for i, chainID := range img.ChainIDs() {
+		id := chainID.Hex()
+		if !driver.Exists(id) {
+			if err := s.unpackLayer(driver, id, parent, img.Manifest.Layers[i].Digest, img.Config.RootFS.DiffIDs[i]); err != nil {
+				return "", fmt.Errorf("Unpack layer %s of %s error %v", img.Manifest.Layers[i].Digest, img.Name, err)
+			}
+		}
+		parent = id
+	}
+	return parent, nil
+}
+
+// 先解压到临时层, 解压的同时校验blob的digest和解压之后的diff id, 全部通过之后才改名成正式的id
+// 中途失败或者被打断时只会留下临时层, Exists 不会把一个不完整的层当成已经解压过的层
+func (s *Store) unpackLayer(driver storage.Driver, id, parent string, blob, diffID digest.Digest) error {
+	if err := blob.Validate(); err != nil {
+		return err
+	}
+	if err := diffID.Validate(); err != nil {
+		return err
+	}
+	f, err := os.Open(s.blobPath(blob))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tmpLayer := id + ".tmp"
+	driver.Remove(tmpLayer)
+	if err := driver.Create(tmpLayer, parent); err != nil {
+		return err
+	}
+	if err := applyVerified(driver, tmpLayer, f, blob, diffID); err != nil {
+		driver.Remove(tmpLayer)
+		return err
+	}
+	if err := driver.Rename(tmpLayer, id); err != nil {
+		driver.Remove(tmpLayer)
+		// 另一个paddle进程已经解压好了同一个层
+		if driver.Exists(id) {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+func applyVerified(driver storage.Driver, id string, f io.Reader, blob, diffID digest.Digest) error {
+	blobVerifier := blob.Verifier()
+	r, err := archive.DecompressStream(io.TeeReader(f, blobVerifier))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	diffVerifier := diffID.Verifier()
+	if err := driver.ApplyDiff(id, io.TeeReader(r, diffVerifier)); err != nil {
+		return err
+	}
+	// tar包结尾的填充和gzip之后的内容不一定被读取, 读完剩下的部分才能得到完整的digest
+	if _, err := io.Copy(diffVerifier, r); err != nil {
+		return err
+	}
+	if _, err := io.Copy(blobVerifier, f); err != nil {
+		return err
+	}
+	if !blobVerifier.Verified() {
+		return fmt.Errorf("Layer blob does not match digest %s", blob)
+	}
+	if !diffVerifier.Verified() {
+		return fmt.Errorf("Layer content does not match diff id %s", diffID)
+	}
+	return nil
+}
+
+// 层的diff id是未压缩的tar包的digest
+func diffID(layerPath string) (digest.Digest, error) {
+	f, err := os.Open(layerPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	r, err := archive.DecompressStream(f)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	return digest.FromReader(r)
+}
+
+// 先写入临时文件再改名, 写到一半时失败不会破坏原来的文件
+func writeFileAtomic(path string, content []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,147 @@
+package image
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/IsolationWyn/paddle/storage"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// 生成一个层的tar包, 内容为空的文件
+func writeTestLayer(t *testing.T, path string, names ...string) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	for _, name := range names {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStoreSharedLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "paddle-image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewStore(filepath.Join(dir, "image"))
+
+	writeTestLayer(t, filepath.Join(dir, "base.tar"), "a", "b")
+	writeTestLayer(t, filepath.Join(dir, "app.tar"), "c", ".wh.a")
+	base, err := store.Commit("base", nil, filepath.Join(dir, "base.tar"), v1.ImageConfig{Cmd: []string{"sh"}}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app, err := store.Commit("app", base, filepath.Join(dir, "app.tar"), v1.ImageConfig{Cmd: []string{"app"}}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(app.Manifest.Layers) != 2 || app.Manifest.Layers[0].Digest != base.Manifest.Layers[0].Digest {
+		t.Fatalf("expected app to share the base layer, got %v", app.Manifest.Layers)
+	}
+	if app.ChainIDs()[0] != base.ChainIDs()[0] || app.ChainIDs()[1] == app.Config.RootFS.DiffIDs[1] {
+		t.Fatalf("unexpected chain ids %v", app.ChainIDs())
+	}
+
+	got, err := store.Get("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Digest != app.Digest || got.Config.Config.Cmd[0] != "app" {
+		t.Fatalf("unexpected image %+v", got)
+	}
+	if images, err := store.List(); err != nil || len(images) != 2 {
+		t.Fatalf("expected 2 images, got %d %v", len(images), err)
+	}
+	if _, err := store.Get("missing"); err == nil {
+		t.Fatal("expected error for missing image")
+	}
+	// 镜像名重新指向其它镜像之后, 按digest仍然能找到原来的镜像
+	if _, err := store.Commit("app", nil, filepath.Join(dir, "base.tar"), v1.ImageConfig{}, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err = store.GetByDigest("app", app.Digest); err != nil || got.Config.Config.Cmd[0] != "app" {
+		t.Fatalf("unexpected image by digest %+v: %v", got, err)
+	}
+	if _, err := store.GetByDigest("app", "sha256:missing"); err == nil {
+		t.Fatal("expected error for invalid digest")
+	}
+	if app, err = store.GetByDigest("app", app.Digest); err != nil {
+		t.Fatal(err)
+	}
+
+	storage.StorageRoot = filepath.Join(dir, "storage")
+	driver, err := storage.New("vfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	top, err := store.Unpack(driver, app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, exists := range map[string]bool{"a": false, "b": true, "c": true, ".wh.a": false} {
+		if _, err := os.Stat(filepath.Join(driver.Dir(top), name)); (err == nil) != exists {
+			t.Errorf("%s: expected exists=%v", name, exists)
+		}
+	}
+	// 基础层在解压app之后依然保留被删除的文件
+	if _, err := os.Stat(filepath.Join(driver.Dir(app.ChainIDs()[0].Hex()), "a")); err != nil {
+		t.Errorf("base layer was modified: %v", err)
+	}
+}
+
+func TestUnpackVerifiesLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "paddle-image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewStore(filepath.Join(dir, "image"))
+	writeTestLayer(t, filepath.Join(dir, "base.tar"), "a")
+	base, err := store.Commit("base", nil, filepath.Join(dir, "base.tar"), v1.ImageConfig{}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.StorageRoot = filepath.Join(dir, "storage")
+	driver, err := storage.New("vfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// blob被替换成另一个合法的tar包, 解压可以成功, 但是digest不一致
+	blob := store.blobPath(base.Manifest.Layers[0].Digest)
+	original, err := ioutil.ReadFile(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestLayer(t, blob, "evil")
+	if _, err := store.Unpack(driver, base); err == nil {
+		t.Fatal("expected error for corrupted layer")
+	}
+	id := base.ChainIDs()[0].Hex()
+	if driver.Exists(id) || driver.Exists(id+".tmp") {
+		t.Fatal("corrupted layer left in the storage")
+	}
+
+	if err := ioutil.WriteFile(blob, original, 0644); err != nil {
+		t.Fatal(err)
+	}
+	top, err := store.Unpack(driver, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(driver.Dir(top), "a")); err != nil {
+		t.Fatal(err)
+	}
+}
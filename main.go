@@ -5,6 +5,8 @@ import (
 	"runtime"
 	"os"
 	"github.com/urfave/cli"
+	"github.com/IsolationWyn/paddle/container"
+	"github.com/IsolationWyn/paddle/image"
 	log "github.com/sirupsen/logrus"	
 )
 const usage = `zzz`
@@ -35,20 +37,35 @@ func main() {
 
 	app.Commands = []cli.Command{
 		initCommand,
+		loggerCommand,
+		pauseCommand,
 		runCommand,
 		stopCommand,
 		removeCommand,
 		commitCommand,
+		imagesCommand,
+		diffCommand,
 		listCommand,
 		logCommand,
 		execCommand,
+		debugCommand,
 		networkCommand,
+		podCommand,
 	}
 
 	app.Before = func(context *cli.Context) error {
 		log.SetFormatter(&log.JSONFormatter{})
 
 		log.SetOutput(os.Stdout)
+
+		// 全局配置中的镜像存储位置对所有命令生效
+		daemonConfig, err := container.LoadDaemonConfig()
+		if err != nil {
+			return err
+		}
+		if daemonConfig.ImageRoot != "" {
+			image.DefaultRoot = daemonConfig.ImageRoot
+		}
 		return nil
 	}
 
@@ -4,9 +4,14 @@ import (
 	_ "github.com/IsolationWyn/paddle/nsenter"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 	"github.com/IsolationWyn/paddle/cgroups/subsystems"
 	"github.com/IsolationWyn/paddle/container"
+	"github.com/IsolationWyn/paddle/image"
 	"github.com/IsolationWyn/paddle/network"
+	"github.com/IsolationWyn/paddle/storage"
+	"github.com/docker/go-units"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 	
@@ -25,10 +30,22 @@ var runCommand = cli.Command{
 			Name:  "ti",
 			Usage: "enable tty",
 		},
+		cli.BoolFlag{
+			Name:  "i",
+			Usage: "keep stdin open, detached containers read it from a fifo in the state dir",
+		},
 		cli.StringFlag{
 			Name:  "m",
 			Usage: "memory limit",
 		},
+		cli.BoolFlag{
+			Name:  "oom-kill-disable",
+			Usage: "disable OOM killer for the container, requires -m",
+		},
+		cli.IntFlag{
+			Name:  "oom-score-adj",
+			Usage: "tune the host's OOM preferences for the container (-1000 to 1000)",
+		},
 		cli.StringFlag{
 			Name:  "cpushare",
 			Usage: "cpushare limit",
@@ -49,18 +66,110 @@ var runCommand = cli.Command{
 			Name:  "e",
 			Usage: "set environment",
 		},
+		cli.StringSliceFlag{
+			Name:  "env-file",
+			Usage: "read environment variables from a file",
+		},
+		cli.StringFlag{
+			Name:  "entrypoint",
+			Usage: "overwrite the default entrypoint of the image",
+		},
 		cli.StringFlag{
 			Name:  "net",
-			Usage: "container network",
+			Usage: "container network, host or container:<name> to share a network namespace",
+		},
+		cli.StringFlag{
+			Name:  "pid",
+			Usage: "pid namespace to use, host or container:<name>",
+		},
+		cli.StringFlag{
+			Name:  "ipc",
+			Usage: "ipc namespace to use, host or container:<name>",
+		},
+		cli.StringFlag{
+			Name:  "uts",
+			Usage: "uts namespace to use, host or container:<name>",
+		},
+		cli.StringFlag{
+			Name:  "cgroupns",
+			Usage: "cgroup namespace to use, host (default) or private",
+		},
+		cli.StringFlag{
+			Name:  "pod",
+			Usage: "run the container in a pod, sharing its network, ipc and uts namespaces and cgroup",
 		},
 		cli.StringSliceFlag{
 			Name: "p",
 			Usage: "port mapping",
 		},
+		cli.StringSliceFlag{
+			Name:  "cap-add",
+			Usage: "add linux capabilities",
+		},
+		cli.StringSliceFlag{
+			Name:  "cap-drop",
+			Usage: "drop linux capabilities",
+		},
+		cli.BoolFlag{
+			Name:  "privileged",
+			Usage: "give all capabilities to this container",
+		},
+		cli.StringSliceFlag{
+			Name:  "security-opt",
+			Usage: "security options, e.g. seccomp=profile.json, seccomp=unconfined or no-new-privileges",
+		},
+		cli.BoolFlag{
+			Name:  "read-only",
+			Usage: "mount the container's root filesystem as read only",
+		},
+		cli.BoolFlag{
+			Name:  "read-only-tmpfs",
+			Usage: "mount writable tmpfs on /run and /tmp when --read-only is set",
+		},
+		cli.StringSliceFlag{
+			Name:  "device",
+			Usage: "add a host device to the container, e.g. /dev/foo[:/dev/bar][:rwm]",
+		},
+		cli.StringFlag{
+			Name:  "shm-size",
+			Usage: "size of /dev/shm, default 64m",
+		},
+		cli.StringFlag{
+			Name:  "hooks",
+			Usage: "json file with OCI hooks (prestart, createRuntime, poststart, poststop), run after the hooks in the daemon config",
+		},
+		cli.StringFlag{
+			Name:  "userns-remap",
+			Usage: "map container root to the subordinate ids of this user in /etc/subuid and /etc/subgid",
+		},
+		cli.StringSliceFlag{
+			Name:  "dns",
+			Usage: "set custom dns servers",
+		},
+		cli.StringSliceFlag{
+			Name:  "dns-search",
+			Usage: "set custom dns search domains, use . for none",
+		},
+		cli.StringSliceFlag{
+			Name:  "dns-option",
+			Usage: "set dns options",
+		},
+		cli.StringSliceFlag{
+			Name:  "add-host",
+			Usage: "add a custom host-to-IP mapping (host:ip)",
+		},
+		cli.StringFlag{
+			Name:  "storage-driver",
+			Usage: "storage driver of the container's root filesystem (overlay2, vfs), detected from the host by default",
+		},
+		cli.StringSliceFlag{
+			Name:  "sysctl",
+			Usage: "set namespaced kernel parameters, e.g. net.ipv4.ip_forward=1",
+		},
 	},
 	Action: func(context *cli.Context) error {
 		if len(context.Args()) < 1 {
-			return fmt.Errorf("Missing container command")
+			return fmt.Errorf("Missing image name")
 		}
 		var cmdArray []string
 		for _, arg := range context.Args() {
@@ -70,7 +179,28 @@ var runCommand = cli.Command{
 		imageName := cmdArray[0]
 		cmdArray = cmdArray[1:]
 
+		// 镜像中的Env, Entrypoint和Cmd作为默认值, 被 --env-file, -e, --entrypoint 和命令行末尾的参数覆盖
+		img, err := image.NewStore(image.DefaultRoot).Get(imageName)
+		if err != nil {
+			return fmt.Errorf("Load config of image %s error %v", imageName, err)
+		}
+		imageConfig := &img.Config.Config
+		var envSlice []string
+		for _, envFile := range context.StringSlice("env-file") {
+			env, err := container.ParseEnvFile(envFile)
+			if err != nil {
+				return fmt.Errorf("Read env file %s error %v", envFile, err)
+			}
+			envSlice = append(envSlice, env...)
+		}
+		envSlice = append(envSlice, context.StringSlice("e")...)
+		config, err := container.MergeImageConfig(imageConfig, context.String("entrypoint"), cmdArray, envSlice)
+		if err != nil {
+			return err
+		}
+
 		createTty := context.Bool("ti")
+		interactive := context.Bool("i")
 		detach := context.Bool("d")
 		
 
@@ -79,20 +209,116 @@ var runCommand = cli.Command{
 		}
 		
 		resConf := &subsystems.ResourceConfig{
-			MemoryLimit: context.String("m"),
-			CpuSet:      context.String("cpuset"),
-			CpuShare:    context.String("cpushare"),
+			MemoryLimit:    context.String("m"),
+			CpuSet:         context.String("cpuset"),
+			CpuShare:       context.String("cpushare"),
+			OomKillDisable: context.Bool("oom-kill-disable"),
+			OomScoreAdj:    context.Int("oom-score-adj"),
+		}
+		// 没有内存限制时禁用OOM killer会让容器在宿主机内存耗尽时挂起
+		if resConf.OomKillDisable && resConf.MemoryLimit == "" {
+			return fmt.Errorf("--oom-kill-disable requires a memory limit (-m)")
+		}
+		if err := container.ValidateOomScoreAdj(resConf.OomScoreAdj); err != nil {
+			return err
 		}
 		log.Infof("createTty %v", createTty)
 
+		secConf := &container.SecurityConfig{
+			CapAdd:        context.StringSlice("cap-add"),
+			CapDrop:       context.StringSlice("cap-drop"),
+			Privileged:    context.Bool("privileged"),
+			ReadOnly:      context.Bool("read-only"),
+			ReadOnlyTmpfs: context.Bool("read-only-tmpfs"),
+			UsernsRemap:   context.String("userns-remap"),
+		}
+		if err := parseSecurityOpts(context.StringSlice("security-opt"), secConf); err != nil {
+			return err
+		}
+
+		devConf := &container.DeviceConfig{
+			ShmSize: container.DefaultShmSize,
+		}
+		for _, spec := range context.StringSlice("device") {
+			device, err := container.ParseDevice(spec)
+			if err != nil {
+				return err
+			}
+			devConf.Devices = append(devConf.Devices, device)
+		}
+		if shmSize := context.String("shm-size"); shmSize != "" {
+			size, err := units.RAMInBytes(shmSize)
+			if err != nil || size <= 0 {
+				return fmt.Errorf("Invalid shm size %s", shmSize)
+			}
+			devConf.ShmSize = size
+		}
+
+		// 全局配置中的hook对所有容器生效, --hooks 中的hook在它们之后运行
+		daemonConfig, err := container.LoadDaemonConfig()
+		if err != nil {
+			return err
+		}
+		hooks := &daemonConfig.Hooks
+		if hooksFile := context.String("hooks"); hooksFile != "" {
+			fileHooks, err := container.LoadHooks(hooksFile)
+			if err != nil {
+				return err
+			}
+			hooks = hooks.Merge(fileHooks)
+		}
+		// --storage-driver 优先, 其次是全局配置, 都没有时自动选择宿主机支持的驱动
+		storageDriver := context.String("storage-driver")
+		if storageDriver == "" {
+			storageDriver = daemonConfig.StorageDriver
+		}
+		driver, err := storage.New(storageDriver)
+		if err != nil {
+			return err
+		}
+
 		volume := context.String("volume")
 		containerName := context.String("n")
 		portmapping := context.StringSlice("p")
 		network := context.String("net")
-		envSlice := context.StringSlice("e")
 
-		Run(createTty, cmdArray, resConf, containerName, imageName, volume, envSlice, network, portmapping)
-		return nil
+		nsConf := &container.NamespaceConfig{
+			Pid: context.String("pid"),
+			Ipc: context.String("ipc"),
+			Uts: context.String("uts"),
+		}
+		// --net 的值为 host 或 container:<name> 时共享namespace, 否则是要连接的网络名
+		if network == container.NamespaceHost || strings.HasPrefix(network, "container:") {
+			nsConf.Net = network
+			network = ""
+		}
+		if nsConf.Pod = context.String("pod"); nsConf.Pod != "" {
+			if nsConf.Net != "" || network != "" || nsConf.Ipc != "" || nsConf.Uts != "" {
+				return fmt.Errorf("--pod can not be used together with --net, --ipc or --uts")
+			}
+		}
+		if nsConf.Sysctls, err = container.ParseSysctls(context.StringSlice("sysctl")); err != nil {
+			return err
+		}
+		switch cgroupns := context.String("cgroupns"); cgroupns {
+		case "", container.NamespaceHost:
+		case "private":
+			nsConf.PrivateCgroups = true
+		default:
+			return fmt.Errorf("Invalid cgroupns mode %s", cgroupns)
+		}
+
+		dnsConf := &container.DNSConfig{
+			Nameservers: context.StringSlice("dns"),
+			Search:      context.StringSlice("dns-search"),
+			Options:     context.StringSlice("dns-option"),
+			ExtraHosts:  context.StringSlice("add-host"),
+		}
+		if err := dnsConf.Validate(); err != nil {
+			return err
+		}
+
+		return Run(createTty, interactive, config, resConf, secConf, devConf, hooks, nsConf, dnsConf, nil, driver, containerName, img, volume, network, portmapping)
 	},
 }
 
@@ -106,17 +332,39 @@ var initCommand = cli.Command{
 	},
 }
 
+var loggerCommand = cli.Command{
+	Name:  "logger",
+	Usage: "Copy stdout and stderr of a detached container into its log. Do not call it outside",
+	Action: func(context *cli.Context) error {
+		if len(context.Args()) < 1 {
+			return fmt.Errorf("Missing container name")
+		}
+		return container.RunLogger(context.Args().Get(0))
+	},
+}
+
 var commitCommand = cli.Command{
 	Name:  "commit",
-	Usage: "commit a container into image",
+	Usage: `commit a container into image
+			paddle commit [--change "CMD ..."] [container] image`,
+	Flags: []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "change",
+			Usage: "apply Dockerfile instruction to the image config: ENV, ENTRYPOINT, CMD, WORKDIR, USER, EXPOSE, STOPSIGNAL, LABEL",
+		},
+	},
 	Action: func(context *cli.Context) error {
 		if len(context.Args()) < 1 {
 			return fmt.Errorf("Missing container name")
 		}
+		// 只有一个参数时沿用原来的用法, 参数为镜像名
+		containerName := ""
 		imageName := context.Args().Get(0)
-		//commitContainer(containerName)
-		commitContainer(imageName)
-		return nil
+		if len(context.Args()) > 1 {
+			containerName = imageName
+			imageName = context.Args().Get(1)
+		}
+		return commitContainer(containerName, imageName, context.StringSlice("change"))
 	},
 }
 
@@ -145,12 +393,62 @@ var logCommand = cli.Command{
 var execCommand = cli.Command{
 	Name:  "exec",
 	Usage: "exec a command into container",
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "ti",
+			Usage: "allocate a pseudo-TTY and keep stdin open",
+		},
+		cli.BoolFlag{
+			Name:  "d",
+			Usage: "detach: run the command in the background",
+		},
+		cli.StringSliceFlag{
+			Name:  "e",
+			Usage: "set environment variables",
+		},
+		cli.StringSliceFlag{
+			Name:  "env-file",
+			Usage: "read in a file of environment variables",
+		},
+		cli.StringFlag{
+			Name:  "w",
+			Usage: "working directory inside the container",
+		},
+		cli.StringFlag{
+			Name:  "u",
+			Usage: "username or UID (format: <name|uid>[:<group|gid>])",
+		},
+	},
+	// 每次exec都会被记录为一个会话, 第一个参数不是子命令时运行下面的Action
+	Subcommands: []cli.Command{
+		{
+			Name:  "ls",
+			Usage: "list exec sessions of a container",
+			Action: func(context *cli.Context) error {
+				if len(context.Args()) < 1 {
+					return fmt.Errorf("Missing container name")
+				}
+				return listExecSessions(context.Args().Get(0))
+			},
+		},
+		{
+			Name:  "kill",
+			Usage: "send a signal to the command of an exec session",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "s",
+					Usage: "signal to send, SIGKILL by default",
+				},
+			},
+			Action: func(context *cli.Context) error {
+				if len(context.Args()) < 1 {
+					return fmt.Errorf("Missing exec session id")
+				}
+				return killExecSession(context.Args().Get(0), context.String("s"))
+			},
+		},
+	},
 	Action: func(context *cli.Context) error {
-		// This is for callback
-		if os.Getenv(ENV_EXEC_PID) != "" {
-			log.Infof("pid callback pid %d", os.Getgid())
-			return nil
-		}
 		if len(context.Args()) < 2 {
 			return fmt.Errorf("Missing container name or command")
 		}
@@ -160,11 +458,73 @@ var execCommand = cli.Command{
 		for _, arg := range context.Args().Tail() {
 			commandArray = append(commandArray, arg)
 		}
-		ExecContainer(containerName, commandArray)
+		execConfig := &container.ExecConfig{
+			Tty:        context.Bool("ti"),
+			Detach:     context.Bool("d"),
+			WorkingDir: context.String("w"),
+			User:       context.String("u"),
+		}
+		if execConfig.Tty && execConfig.Detach {
+			return fmt.Errorf("ti and d paramter can not both provided")
+		}
+		for _, envFile := range context.StringSlice("env-file") {
+			env, err := container.ParseEnvFile(envFile)
+			if err != nil {
+				return fmt.Errorf("Read env file %s error %v", envFile, err)
+			}
+			execConfig.Env = append(execConfig.Env, env...)
+		}
+		execConfig.Env = append(execConfig.Env, context.StringSlice("e")...)
+		exitCode, err := ExecContainer(containerName, commandArray, execConfig)
+		if err != nil {
+			return err
+		}
+		// paddle exec 的退出码与容器中命令的退出码一致
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
 		return nil
 	},
 }
 
+var imagesCommand = cli.Command{
+	Name:  "images",
+	Usage: "list images",
+	Action: func(context *cli.Context) error {
+		return listImages()
+	},
+}
+
+var diffCommand = cli.Command{
+	Name:  "diff",
+	Usage: "inspect changes to files or directories on a container's filesystem",
+	Action: func(context *cli.Context) error {
+		if len(context.Args()) < 1 {
+			return fmt.Errorf("Missing container name")
+		}
+		return diffContainer(context.Args().Get(0))
+	},
+}
+
+var debugCommand = cli.Command{
+	Name: "debug",
+	Usage: `start a temporary container from a tools image sharing the pid, network and ipc namespaces of a running container
+			paddle debug [--image toolbox] container [command]`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "image",
+			Value: DefaultDebugImage,
+			Usage: "tools image, the root filesystem of the container is mounted at " + DebugTargetPath,
+		},
+	},
+	Action: func(context *cli.Context) error {
+		if len(context.Args()) < 1 {
+			return fmt.Errorf("Missing container name")
+		}
+		return debugContainer(context.Args().Get(0), context.String("image"), context.Args().Tail())
+	},
+}
+
 var networkCommand = cli.Command{
 	Name:  "network",
 	Usage: "container network commands",
@@ -221,6 +581,101 @@ var networkCommand = cli.Command{
 	},
 }
 
+var pauseCommand = cli.Command{
+	Name:  "pause",
+	Usage: "Hold the namespaces of a pod. Do not call it outside",
+	Action: func(context *cli.Context) error {
+		if len(context.Args()) < 1 {
+			return fmt.Errorf("Missing pod name")
+		}
+		return container.RunPause(context.Args().Get(0))
+	},
+}
+
+var podCommand = cli.Command{
+	Name:  "pod",
+	Usage: "manage pods, groups of containers sharing network, ipc and uts namespaces and a cgroup",
+	Subcommands: []cli.Command{
+		{
+			Name:  "create",
+			Usage: "create and start a pod",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "m",
+					Usage: "memory limit of the pod",
+				},
+				cli.StringFlag{
+					Name:  "cpushare",
+					Usage: "cpushare limit of the pod",
+				},
+				cli.StringFlag{
+					Name:  "cpuset",
+					Usage: "cpuset limit of the pod",
+				},
+				cli.StringFlag{
+					Name:  "net",
+					Usage: "pod network",
+				},
+				cli.StringSliceFlag{
+					Name:  "p",
+					Usage: "port mapping",
+				},
+			},
+			Action: func(context *cli.Context) error {
+				if len(context.Args()) < 1 {
+					return fmt.Errorf("Missing pod name")
+				}
+				return createPod(&container.PodInfo{
+					Name:        context.Args().Get(0),
+					MemoryLimit: context.String("m"),
+					CpuShare:    context.String("cpushare"),
+					CpuSet:      context.String("cpuset"),
+					Network:     context.String("net"),
+					PortMapping: context.StringSlice("p"),
+				})
+			},
+		},
+		{
+			Name:  "ls",
+			Usage: "list pods",
+			Action: func(context *cli.Context) error {
+				listPods()
+				return nil
+			},
+		},
+		{
+			Name:  "start",
+			Usage: "start a stopped pod",
+			Action: func(context *cli.Context) error {
+				if len(context.Args()) < 1 {
+					return fmt.Errorf("Missing pod name")
+				}
+				return startPod(context.Args().Get(0))
+			},
+		},
+		{
+			Name:  "stop",
+			Usage: "stop a pod and all its containers",
+			Action: func(context *cli.Context) error {
+				if len(context.Args()) < 1 {
+					return fmt.Errorf("Missing pod name")
+				}
+				return stopPod(context.Args().Get(0))
+			},
+		},
+		{
+			Name:  "rm",
+			Usage: "remove a stopped pod and its containers",
+			Action: func(context *cli.Context) error {
+				if len(context.Args()) < 1 {
+					return fmt.Errorf("Missing pod name")
+				}
+				return removePod(context.Args().Get(0))
+			},
+		},
+	},
+}
+
 var stopCommand = cli.Command{
 	Name:  "stop",
 	Usage: "stop a container",
@@ -247,4 +702,32 @@ var removeCommand = cli.Command{
 	},
 }
 
-
+// 解析 --security-opt 参数, 支持 key=value 和 key:value 两种写法
+func parseSecurityOpts(opts []string, secConf *container.SecurityConfig) error {
+	for _, opt := range opts {
+		if opt == "no-new-privileges" {
+			secConf.NoNewPrivileges = true
+			continue
+		}
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 {
+			kv = strings.SplitN(opt, ":", 2)
+		}
+		if len(kv) != 2 {
+			return fmt.Errorf("Invalid security option %s", opt)
+		}
+		switch kv[0] {
+		case "seccomp":
+			secConf.SeccompProfile = kv[1]
+		case "no-new-privileges":
+			noNewPrivileges, err := strconv.ParseBool(kv[1])
+			if err != nil {
+				return fmt.Errorf("Invalid security option %s", opt)
+			}
+			secConf.NoNewPrivileges = noNewPrivileges
+		default:
+			return fmt.Errorf("Unknown security option %s", opt)
+		}
+	}
+	return nil
+}
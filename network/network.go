@@ -356,6 +356,7 @@ func Connect(networkName string, cinfo *container.ContainerInfo) error {
 	if err != nil {
 		return err
 	}
+	cinfo.IPAddress = ip.String()
 
 	// 创建网络端点
 	ep := &Endpoint{
@@ -9,39 +9,359 @@ package nsenter
 #include <stdlib.h>
 #include <string.h>
 #include <fcntl.h>
+#include <limits.h>
+#include <stdint.h>
+#include <signal.h>
+#include <grp.h>
+#include <sys/prctl.h>
+#include <sys/resource.h>
+#include <sys/syscall.h>
+#include <sys/wait.h>
+#include <linux/capability.h>
+#include <linux/filter.h>
+#include <linux/seccomp.h>
+
+// paddle exec 通过 "/proc/self/exe nsenter" 启动当前进程, 配置从这个fd读取
+#define CONFIG_FD 3
+// exec会话的 status 文件, 写入命令的PID和退出码, 没有打开时忽略
+#define STATUS_FD 4
+
+#define MAX_NAMESPACES 16
+#define MAX_ITEMS 4096
+
+// 父进程通过管道传来的配置, 对应 container.NsenterConfig
+struct nsenter_config {
+	pid_t pid;
+	char *namespaces[MAX_NAMESPACES];
+	int ns_len;
+	char *args[MAX_ITEMS + 1];
+	int args_len;
+	char *cwd;
+	uid_t uid;
+	gid_t gid;
+	gid_t groups[MAX_ITEMS];
+	int groups_len;
+	uint64_t caps;
+	int nnp;
+};
+
+// 打印出错的步骤和errno之后退出, 与docker一致返回126
+static void bail(const char *fmt, const char *arg) {
+	fprintf(stderr, "paddle exec: ");
+	fprintf(stderr, fmt, arg, strerror(errno));
+	fprintf(stderr, "\n");
+	exit(126);
+}
+
+// 读满len个字节, 对端提前关闭时返回-1
+static int read_full(int fd, void *buf, size_t len) {
+	size_t done = 0;
+	while (done < len) {
+		ssize_t n = read(fd, (char *)buf + done, len - done);
+		if (n == -1 && errno == EINTR) {
+			continue;
+		}
+		if (n <= 0) {
+			return -1;
+		}
+		done += n;
+	}
+	return 0;
+}
+
+// 读取一条以'\0'结尾的记录, 返回的字符串需要由调用者释放
+static char *read_record(int fd) {
+	size_t len = 0, cap = 64;
+	char *buf = malloc(cap);
+	for (;;) {
+		if (!buf) {
+			errno = ENOMEM;
+			bail("read %s failed: %s", "config");
+		}
+		if (read_full(fd, buf + len, 1) == -1) {
+			errno = EPIPE;
+			bail("read %s failed: %s", "config");
+		}
+		if (buf[len] == '\0') {
+			return buf;
+		}
+		if (++len == cap) {
+			cap *= 2;
+			buf = realloc(buf, cap);
+		}
+	}
+}
+
+// 依次读取 key=value 记录, 直到遇到空记录
+static void read_config(struct nsenter_config *config) {
+	memset(config, 0, sizeof(*config));
+	for (;;) {
+		char *record = read_record(CONFIG_FD);
+		if (record[0] == '\0') {
+			free(record);
+			break;
+		}
+		char *value = strchr(record, '=');
+		if (!value) {
+			errno = EINVAL;
+			bail("invalid config record %s: %s", record);
+		}
+		*value++ = '\0';
+		if (strcmp(record, "pid") == 0) {
+			config->pid = atoi(value);
+		} else if (strcmp(record, "ns") == 0 && config->ns_len < MAX_NAMESPACES) {
+			config->namespaces[config->ns_len++] = strdup(value);
+		} else if (strcmp(record, "arg") == 0 && config->args_len < MAX_ITEMS) {
+			config->args[config->args_len++] = strdup(value);
+		} else if (strcmp(record, "cwd") == 0) {
+			config->cwd = strdup(value);
+		} else if (strcmp(record, "uid") == 0) {
+			config->uid = (uid_t)strtoul(value, NULL, 10);
+		} else if (strcmp(record, "gid") == 0) {
+			config->gid = (gid_t)strtoul(value, NULL, 10);
+		} else if (strcmp(record, "group") == 0 && config->groups_len < MAX_ITEMS) {
+			config->groups[config->groups_len++] = (gid_t)strtoul(value, NULL, 10);
+		} else if (strcmp(record, "caps") == 0) {
+			config->caps = strtoull(value, NULL, 10);
+		} else if (strcmp(record, "nnp") == 0) {
+			config->nnp = 1;
+		}
+		free(record);
+	}
+	config->args[config->args_len] = NULL;
+	if (config->pid <= 0 || config->args_len == 0) {
+		errno = EINVAL;
+		bail("invalid %s, missing pid or command: %s", "config");
+	}
+}
+
+// 读取父进程编译好的seccomp过滤器, 格式为指令数(uint32)加上指令本身, 指令数为0表示不安装过滤器
+// 父进程在把当前进程加入容器的cgroup之后才写入, 所以这里的读取同时保证了进入容器之前已经受到cgroup的限制
+static struct sock_fprog *read_seccomp(void) {
+	uint32_t len;
+	if (read_full(CONFIG_FD, &len, sizeof(len)) == -1) {
+		errno = EPIPE;
+		bail("read %s failed: %s", "seccomp filter");
+	}
+	struct sock_fprog *prog = NULL;
+	if (len > 0) {
+		prog = malloc(sizeof(struct sock_fprog));
+		prog->len = len;
+		prog->filter = calloc(len, sizeof(struct sock_filter));
+		if (read_full(CONFIG_FD, prog->filter, len * sizeof(struct sock_filter)) == -1) {
+			errno = EPIPE;
+			bail("read %s failed: %s", "seccomp filter");
+		}
+	}
+	close(CONFIG_FD);
+	return prog;
+}
+
+static void install_seccomp(struct sock_fprog *prog) {
+	if (prog && prctl(PR_SET_SECCOMP, SECCOMP_MODE_FILTER, prog, 0, 0) == -1) {
+		bail("install %s failed: %s", "seccomp filter");
+	}
+}
+
+// 使用与容器init进程相同的rlimit, 提高hard limit需要CAP_SYS_RESOURCE, 所以要在收缩capability之前进行
+static void copy_rlimits(pid_t pid) {
+	int r;
+	struct rlimit lim;
+	for (r = 0; r < RLIM_NLIMITS; r++) {
+		if (prlimit(pid, r, NULL, &lim) == -1 || setrlimit(r, &lim) == -1) {
+			bail("copy %s failed: %s", "rlimits");
+		}
+	}
+}
+
+// 提前打开容器init进程的各个namespace, 加入mnt namespace之后 /proc 就是容器内的了
+static void open_namespaces(struct nsenter_config *config, int *fds) {
+	char path[PATH_MAX];
+	int i;
+	for (i = 0; i < config->ns_len; i++) {
+		snprintf(path, sizeof(path), "/proc/%d/ns/%s", config->pid, config->namespaces[i]);
+		fds[i] = open(path, O_RDONLY | O_CLOEXEC);
+		if (fds[i] == -1) {
+			bail("open namespace %s failed: %s", path);
+		}
+	}
+}
+
+// 按父进程给出的顺序加入namespace, 任何一个失败都直接退出, 不能让命令运行在一半宿主机一半容器的环境中
+static void join_namespaces(struct nsenter_config *config, int *fds) {
+	int i;
+	for (i = 0; i < config->ns_len; i++) {
+		if (setns(fds[i], 0) == -1) {
+			bail("join %s namespace failed: %s", config->namespaces[i]);
+		}
+		close(fds[i]);
+	}
+}
+
+// 从bounding set中去掉mask之外的capability, 需要CAP_SETPCAP, 所以在切换用户和capset之前进行
+static void drop_bounding_set(uint64_t mask) {
+	int i;
+	for (i = 0; i < 64; i++) {
+		if (mask & (1ULL << i)) {
+			continue;
+		}
+		// 超出内核支持范围的编号会返回EINVAL, 直接忽略
+		prctl(PR_CAPBSET_DROP, i, 0, 0, 0);
+	}
+}
+
+// 将effective, permitted, inheritable设置为mask给出的集合, 与容器init进程保持一致
+// 切换到非root用户会清空effective, 所以在setup_user之后进行
+static void apply_capabilities(uint64_t mask) {
+	int i;
+	struct __user_cap_header_struct header = { _LINUX_CAPABILITY_VERSION_3, 0 };
+	struct __user_cap_data_struct data[2];
+	for (i = 0; i < 2; i++) {
+		data[i].effective = (uint32_t)(mask >> (32 * i));
+		data[i].permitted = data[i].effective;
+		data[i].inheritable = data[i].effective;
+	}
+	if (syscall(SYS_capset, &header, data) == -1) {
+		bail("%s failed: %s", "capset");
+	}
+}
+
+// 切换到exec指定的用户, 加入了user namespace时这里的id是容器内的id
+static void setup_user(struct nsenter_config *config) {
+	if (setgroups(config->groups_len, config->groups) == -1) {
+		bail("%s failed: %s", "setgroups");
+	}
+	if (setresgid(config->gid, config->gid, config->gid) == -1) {
+		bail("%s failed: %s", "setgid");
+	}
+	if (setresuid(config->uid, config->uid, config->uid) == -1) {
+		bail("%s failed: %s", "setuid");
+	}
+}
+
+// 是否由 paddle exec 以 "/proc/self/exe nsenter" 的方式启动
+static int is_nsenter(void) {
+	char buf[64];
+	int fd = open("/proc/self/cmdline", O_RDONLY | O_CLOEXEC);
+	if (fd == -1) {
+		return 0;
+	}
+	ssize_t n = read(fd, buf, sizeof(buf) - 1);
+	close(fd);
+	if (n <= 0) {
+		return 0;
+	}
+	buf[n] = '\0';
+	size_t first = strlen(buf) + 1;
+	return first < (size_t)n && strcmp(buf + first, "nsenter") == 0;
+}
+
+// 在 status 文件中追加一条记录, 这里失败不影响命令本身的运行
+static void write_status(const char *key, int value) {
+	dprintf(STATUS_FD, "%s=%d\n", key, value);
+}
+
+// 记录命令的退出码后退出
+static void finish(int code) {
+	write_status("exit", code);
+	exit(code);
+}
+
+static pid_t child_pid;
+
+// 把paddle exec收到的信号转发给容器中的进程
+static void forward_signal(int sig) {
+	if (child_pid > 0) {
+		kill(child_pid, sig);
+	}
+}
+
 __attribute__((constructor)) void enter_namespace(void) {
-	char *paddle_pid;
-	paddle_pid = getenv("paddle_pid");
-	if (paddle_pid) {
-		//fprintf(stdout, "got paddle_pid=%s\n", paddle_pid);
-	} else {
-		//fprintf(stdout, "missing paddle_pid env skip nsenter");
+	if (!is_nsenter()) {
 		return;
 	}
-	char *paddle_cmd;
-	paddle_cmd = getenv("paddle_cmd");
-	if (paddle_cmd) {
-		//fprintf(stdout, "got paddle_cmd=%s\n", paddle_cmd);
+	// status 文件不能泄漏给容器中的命令
+	fcntl(STATUS_FD, F_SETFD, FD_CLOEXEC);
+	struct nsenter_config config;
+	read_config(&config);
+	copy_rlimits(config.pid);
+	struct sock_fprog *seccomp_prog = read_seccomp();
+
+	// 容器init进程的根目录, pivot_root之后它不一定是mnt namespace的根, 所以加入之后还要chroot到这里
+	char path[PATH_MAX];
+	snprintf(path, sizeof(path), "/proc/%d/root", config.pid);
+	int rootfd = open(path, O_RDONLY | O_DIRECTORY | O_CLOEXEC);
+	if (rootfd == -1) {
+		bail("open container root %s failed: %s", path);
+	}
+	int fds[MAX_NAMESPACES];
+	open_namespaces(&config, fds);
+	join_namespaces(&config, fds);
+	if (fchdir(rootfd) == -1 || chroot(".") == -1) {
+		bail("chroot to %s failed: %s", path);
+	}
+	close(rootfd);
+
+	// 与容器init进程的顺序相同: 没有no_new_privs时安装seccomp需要CAP_SYS_ADMIN, 所以在收缩capability之前进行
+	// 设置了no_new_privs时则放到切换用户之后, 尽量减少过滤器需要放行的系统调用
+	if (config.nnp) {
+		if (prctl(PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0) == -1) {
+			bail("set %s failed: %s", "no_new_privs");
+		}
 	} else {
-		//fprintf(stdout, "missing paddle_cmd env skip nsenter");
-		return;
+		install_seccomp(seccomp_prog);
+	}
+	// 与runc的顺序一致: setgroups和setuid需要CAP_SETGID和CAP_SETUID, 在capset去掉它们之前进行
+	// PR_SET_KEEPCAPS 让切换到非root用户时保留permitted, 之后的capset才能设置effective
+	drop_bounding_set(config.caps);
+	if (prctl(PR_SET_KEEPCAPS, 1, 0, 0, 0) == -1) {
+		bail("set %s failed: %s", "keepcaps");
 	}
+	setup_user(&config);
+	if (prctl(PR_SET_KEEPCAPS, 0, 0, 0, 0) == -1) {
+		bail("clear %s failed: %s", "keepcaps");
+	}
+	apply_capabilities(config.caps);
+	if (config.nnp) {
+		install_seccomp(seccomp_prog);
+	}
+	// 以exec的用户身份进入工作目录, 与用户进程的权限检查一致
+	if (chdir(config.cwd ? config.cwd : "/") == -1) {
+		bail("chdir to %s failed: %s", config.cwd);
+	}
+
+	// setns加入pid namespace只对之后创建的子进程生效, 所以需要fork一次
+	child_pid = fork();
+	if (child_pid == -1) {
+		bail("%s failed: %s", "fork");
+	}
+	if (child_pid == 0) {
+		execvp(config.args[0], config.args);
+		// 与docker一致, 命令不存在时返回127, 其它错误返回126
+		fprintf(stderr, "paddle exec: exec %s failed: %s\n", config.args[0], strerror(errno));
+		exit(errno == ENOENT ? 127 : 126);
+	}
+	write_status("pid", child_pid);
+
+	// 终端产生的SIGINT和SIGQUIT会同时发给容器中的进程, 不需要再转发
+	signal(SIGINT, SIG_IGN);
+	signal(SIGQUIT, SIG_IGN);
 	int i;
-	char nspath[1024];
-	char *namespaces[] = { "ipc", "uts", "net", "pid", "mnt" };
-	for (i=0; i<5; i++) {
-		sprintf(nspath, "/proc/%s/ns/%s", paddle_pid, namespaces[i]);
-      int fd = open(nspath, O_RDONLY);
-		if (setns(fd, 0) == -1) {
-			//fprintf(stderr, "setns on %s namespace failed: %s\n", namespaces[i], strerror(errno));
-		} else {
-			//fprintf(stdout, "setns on %s namespace succeeded\n", namespaces[i]);
-		}
-		close(fd);
-	}
-	int res = system(paddle_cmd);
-	exit(0);
-	return;
+	int sigs[] = { SIGTERM, SIGHUP, SIGUSR1, SIGUSR2 };
+	for (i = 0; i < sizeof(sigs) / sizeof(sigs[0]); i++) {
+		signal(sigs[i], forward_signal);
+	}
+	int status;
+	while (waitpid(child_pid, &status, 0) == -1) {
+		if (errno != EINTR) {
+			bail("%s failed: %s", "wait");
+		}
+	}
+	// 命令被信号杀死时与shell一致返回128+信号值
+	if (WIFSIGNALED(status)) {
+		finish(128 + WTERMSIG(status));
+	}
+	finish(WEXITSTATUS(status));
 }
 */
-import "C"
\ No newline at end of file
+import "C"
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/IsolationWyn/paddle/cgroups"
+	"github.com/IsolationWyn/paddle/cgroups/subsystems"
+	"github.com/IsolationWyn/paddle/container"
+	"github.com/IsolationWyn/paddle/network"
+	log "github.com/sirupsen/logrus"
+)
+
+// 创建pod: 记录pod的配置, 创建pod的cgroup, 然后启动pause进程
+func createPod(podInfo *container.PodInfo) error {
+	if _, err := getPodInfoByName(podInfo.Name); err == nil {
+		return fmt.Errorf("Pod %s already exists", podInfo.Name)
+	}
+	podInfo.Id = randStringBytes(10)
+	podInfo.CreatedTime = time.Now().Format("2006-01-02 15:04:05")
+	podInfo.Status = container.STOP
+	if err := writePodInfo(podInfo); err != nil {
+		return err
+	}
+	return startPod(podInfo.Name)
+}
+
+// 启动pod的pause进程, 把它加入pod的cgroup并连接网络
+// 成员容器通过pause进程的 /proc/<pid>/ns 加入pod的namespace, 所以pause进程重启之后需要重新创建成员容器
+func startPod(podName string) error {
+	podInfo, err := getPodInfoByName(podName)
+	if err != nil {
+		return err
+	}
+	if podInfo.Status == container.RUNNING {
+		return fmt.Errorf("Pod %s is already running", podName)
+	}
+
+	cmd, err := container.NewPauseProcess(podName)
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("Start pause process error %v", err)
+	}
+	pid := cmd.Process.Pid
+
+	// pod的cgroup是所有成员容器cgroup的父节点, 这里的限制由所有成员共享
+	res := &subsystems.ResourceConfig{
+		MemoryLimit: podInfo.MemoryLimit,
+		CpuShare:    podInfo.CpuShare,
+		CpuSet:      podInfo.CpuSet,
+	}
+	// pod的cgroup在所有subsystem中都要创建, 成员容器的cgroup才能创建在它下面
+	cgroupManager := cgroups.NewCgroupManager(container.PodCgroupPath(podName))
+	if err := cgroupManager.Set(res); err != nil {
+		syscall.Kill(pid, syscall.SIGKILL)
+		cmd.Wait()
+		return fmt.Errorf("Set cgroup of pod %s error %v", podName, err)
+	}
+	if err := cgroupManager.Apply(pid); err != nil {
+		syscall.Kill(pid, syscall.SIGKILL)
+		cmd.Wait()
+		return fmt.Errorf("Apply cgroup of pod %s error %v", podName, err)
+	}
+
+	if podInfo.Network != "" {
+		network.Init()
+		containerInfo := &container.ContainerInfo{
+			Id:          podInfo.Id,
+			Pid:         strconv.Itoa(pid),
+			Name:        podName,
+			PortMapping: podInfo.PortMapping,
+		}
+		if err := network.Connect(podInfo.Network, containerInfo); err != nil {
+			syscall.Kill(pid, syscall.SIGKILL)
+			return fmt.Errorf("Connect network %s error %v", podInfo.Network, err)
+		}
+		podInfo.IPAddress = containerInfo.IPAddress
+	}
+
+	podInfo.InfraPid = strconv.Itoa(pid)
+	podInfo.Status = container.RUNNING
+	return writePodInfo(podInfo)
+}
+
+// 停止pod: 先停止所有运行中的成员容器, 再停止pause进程
+func stopPod(podName string) error {
+	podInfo, err := getPodInfoByName(podName)
+	if err != nil {
+		return err
+	}
+	for _, containerInfo := range podContainers(podName) {
+		if containerInfo.Status == container.RUNNING {
+			stopContainer(containerInfo.Name)
+		}
+	}
+	if podInfo.Status == container.RUNNING {
+		pid, err := strconv.Atoi(podInfo.InfraPid)
+		if err != nil {
+			return fmt.Errorf("Invalid pause pid %s", podInfo.InfraPid)
+		}
+		if err := syscall.Kill(pid, syscall.SIGTERM); err != nil && err != syscall.ESRCH {
+			return fmt.Errorf("Stop pause process error %v", err)
+		}
+	}
+	podInfo.Status = container.STOP
+	podInfo.InfraPid = " "
+	return writePodInfo(podInfo)
+}
+
+// 删除已经停止的pod, 同时删除它的成员容器和cgroup
+func removePod(podName string) error {
+	podInfo, err := getPodInfoByName(podName)
+	if err != nil {
+		return err
+	}
+	if podInfo.Status != container.STOP {
+		return fmt.Errorf("Couldn't remove running pod %s", podName)
+	}
+	for _, containerInfo := range podContainers(podName) {
+		removeContainer(containerInfo.Name)
+		cgroups.NewCgroupManager(container.ContainerCgroupPath(containerInfo.Name, podName)).Destroy()
+	}
+	cgroups.NewCgroupManager(container.PodCgroupPath(podName)).Destroy()
+	dirURL := fmt.Sprintf(container.DefaultPodLocation, podName)
+	if err := os.RemoveAll(dirURL); err != nil {
+		return fmt.Errorf("Remove dir %s error %v", dirURL, err)
+	}
+	return nil
+}
+
+func listPods() {
+	dirURL := fmt.Sprintf(container.DefaultPodLocation, "")
+	files, err := ioutil.ReadDir(dirURL)
+	if err != nil && !os.IsNotExist(err) {
+		log.Errorf("Read dir %s error %v", dirURL, err)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 12, 1, 3, ' ', 0)
+	fmt.Fprint(w, "ID\tNAME\tINFRA PID\tSTATUS\tCONTAINERS\tCREATED\n")
+	for _, file := range files {
+		podInfo, err := getPodInfoByName(file.Name())
+		if err != nil {
+			log.Errorf("Get pod info error %v", err)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\n",
+			podInfo.Id,
+			podInfo.Name,
+			podInfo.InfraPid,
+			podInfo.Status,
+			len(podContainers(podInfo.Name)),
+			podInfo.CreatedTime)
+	}
+	if err := w.Flush(); err != nil {
+		log.Errorf("Flush error %v", err)
+	}
+}
+
+// 属于某个pod的所有容器
+func podContainers(podName string) []*container.ContainerInfo {
+	dirURL := fmt.Sprintf(container.DefaultInfoLocation, "")
+	files, err := ioutil.ReadDir(dirURL)
+	if err != nil {
+		return nil
+	}
+	var containers []*container.ContainerInfo
+	for _, file := range files {
+		containerInfo, err := container.GetContainerInfo(file)
+		if err != nil {
+			continue
+		}
+		if containerInfo.Pod == podName {
+			containers = append(containers, containerInfo)
+		}
+	}
+	return containers
+}
+
+func getPodInfoByName(podName string) (*container.PodInfo, error) {
+	configFilePath := fmt.Sprintf(container.DefaultPodLocation, podName) + container.ConfigName
+	contentBytes, err := ioutil.ReadFile(configFilePath)
+	if err != nil {
+		return nil, err
+	}
+	var podInfo container.PodInfo
+	if err := json.Unmarshal(contentBytes, &podInfo); err != nil {
+		return nil, err
+	}
+	return &podInfo, nil
+}
+
+// /var/run/paddle-pods/{{podName}}/config.json
+func writePodInfo(podInfo *container.PodInfo) error {
+	dirURL := fmt.Sprintf(container.DefaultPodLocation, podInfo.Name)
+	if err := os.MkdirAll(dirURL, 0622); err != nil {
+		return fmt.Errorf("Mkdir %s error %v", dirURL, err)
+	}
+	jsonBytes, err := json.Marshal(podInfo)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dirURL+container.ConfigName, jsonBytes, 0622)
+}
@@ -4,7 +4,10 @@ import (
 	"github.com/IsolationWyn/paddle/network"
 	"syscall"
 	"os/exec"
+	"os/signal"
+	"runtime"
 	"text/tabwriter"
+	"io"
 	"io/ioutil"
 	"fmt"
 	"math/rand"
@@ -15,12 +18,17 @@ import (
 	"github.com/IsolationWyn/paddle/cgroups"
 	"github.com/IsolationWyn/paddle/cgroups/subsystems"
 	"github.com/IsolationWyn/paddle/container"
+	"github.com/IsolationWyn/paddle/image"
+	"github.com/IsolationWyn/paddle/seccomp"
+	"github.com/IsolationWyn/paddle/storage"
+	"github.com/opencontainers/image-spec/specs-go/v1"
 	log "github.com/sirupsen/logrus"
 	"os"
 )
 
-func Run(tty bool, cmdArray []string, res *subsystems.ResourceConfig, containerName, imageName, volume string, envSlice []string, 
-	nw string, portmapping []string) {
+// config 是镜像配置和命令行参数合并之后的结果, Cmd 为容器要运行的完整命令
+func Run(tty, interactive bool, config *v1.ImageConfig, res *subsystems.ResourceConfig, sec *container.SecurityConfig, dev *container.DeviceConfig, hooks *container.Hooks, nsConf *container.NamespaceConfig, dns *container.DNSConfig, mounts []*container.BindMount, driver storage.Driver, containerName string, img *image.Image, volume string, 
+	nw string, portmapping []string) error {
 
 	containerID := randStringBytes(10)
 	if containerName == "" {
@@ -28,37 +36,130 @@ func Run(tty bool, cmdArray []string, res *subsystems.ResourceConfig, containerN
 	}
 	log.Infof("container name is %s", containerName) 
 
-	parent, writePipe := container.NewParentProcess(tty, containerName, imageName, volume, envSlice)
+	// 根据默认集合和 --cap-add/--cap-drop/--privileged 计算容器的capability
+	capabilities, err := container.TweakCapabilities(sec.CapAdd, sec.CapDrop, sec.Privileged)
+	if err != nil {
+		return fmt.Errorf("Tweak capabilities error %v", err)
+	}
+	seccompConfig, err := loadSeccompProfile(sec)
+	if err != nil {
+		return fmt.Errorf("Load seccomp profile error %v", err)
+	}
+
+	// 容器root映射到宿主机上的普通用户
+	var idMappings *container.IDMappings
+	if sec.UsernsRemap != "" {
+		if sec.Privileged {
+			return fmt.Errorf("Privileged mode is incompatible with user namespace remapping")
+		}
+		idMappings, err = container.NewIDMappings(sec.UsernsRemap)
+		if err != nil {
+			return fmt.Errorf("Load id mappings for %s error %v", sec.UsernsRemap, err)
+		}
+	}
+
+	namespaces, err := resolveNamespaces(nsConf, idMappings != nil)
+	if err != nil {
+		return fmt.Errorf("Resolve namespaces error %v", err)
+	}
+	if err := container.ValidateSysctls(nsConf.Sysctls, namespaces); err != nil {
+		return fmt.Errorf("Validate sysctls error %v", err)
+	}
+	// 只有新建的uts namespace才设置主机名, 否则会修改宿主机或者其它容器的主机名
+	hostname := ""
+	envHostname := containerName
+	if uts := namespaces.Get("uts"); uts != nil && uts.Path == "" {
+		hostname = containerName
+	} else if nsConf.Pod != "" {
+		envHostname = nsConf.Pod
+	} else if _, target, _ := container.ParseNamespaceMode(nsConf.Uts); target != "" {
+		envHostname = target
+	} else if envHostname, err = os.Hostname(); err != nil {
+		return fmt.Errorf("Get hostname error %v", err)
+	}
+	// 容器从默认的环境变量开始, 再依次覆盖镜像和命令行指定的变量
+	config.Env = container.MergeEnv(container.DefaultEnv(envHostname, tty), config.Env)
+
+	// -ti 时为容器分配一个pty
+	var console *container.Console
+	if tty {
+		console, err = container.NewConsole()
+		if err != nil {
+			return fmt.Errorf("New console error %v", err)
+		}
+	}
+
+	parent, writePipe, execSync := container.NewParentProcess(console, interactive, driver, containerName, img, volume, namespaces, idMappings)
 	if parent == nil {
-		log.Errorf("New parent process error")
-		return
+		return fmt.Errorf("New parent process error")
 	}
-	if err := parent.Start(); err != nil {
-		log.Error(err)
+	defer execSync.Close()
+	err = startParent(parent, namespaces)
+	// 管道的另一端已经交给容器进程, 父进程关闭自己持有的这一份, 否则init进程exec之后读exec同步管道不会结束
+	for _, f := range parent.ExtraFiles {
+		f.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("Start container process error %v", err)
+	}
+	// init进程还在等待配置, 此时设置的oom_score_adj会被用户进程及其子进程继承
+	if err := container.SetOomScoreAdj(strconv.Itoa(parent.Process.Pid), res.OomScoreAdj); err != nil {
+		writePipe.Close()
+		parent.Process.Kill()
+		parent.Wait()
+		container.DeleteWorkSpace(driver, volume, containerName)
+		return fmt.Errorf("Set oom score adj error %v", err)
+	}
+	// slave端已经交给容器进程, 父进程需要关闭自己持有的这一份, 否则容器退出后读master不会结束
+	if console != nil {
+		console.Slave.Close()
 	}
 
 
 	// 记录容器信息
-	containerName, err := recordContainerInfo(parent.Process.Pid, cmdArray, containerName)
+	containerName, err = recordContainerInfo(parent.Process.Pid, config, containerName, img, capabilities, idMappings, hooks, namespaces, nsConf.Pod, res.OomScoreAdj, seccompConfig, sec.NoNewPrivileges, driver.Name())
 	if err != nil {
-		log.Errorf("Record container info error %v", err)
-		return
+		return fmt.Errorf("Record container info error %v", err)
 	}
 		
+	// privileged 容器可以访问所有设备, 否则只放行标准设备和 --device 传入的设备
+	if sec.Privileged {
+		res.DeviceRules = []string{"a *:* rwm"}
+	} else {
+		res.DeviceRules = container.DeviceCgroupRules(dev.Devices)
+	}
+
 	// 创建cgroup manager, 并通过调用set和apply设置资源限制并使限制在容器上生效
-	cgroupManager := cgroups.NewCgroupManager(containerName)
+	// pod的成员容器的cgroup创建在pod的cgroup下, 同时受pod级别的限制
+	cgroupManager := cgroups.NewCgroupManager(container.ContainerCgroupPath(containerName, nsConf.Pod))
 	defer cgroupManager.Destroy()
-	// 设置资源限制
-	cgroupManager.Set(res)
-	// 将容器进程加入到各个subsystem挂载对应的cgroup中
-	cgroupManager.Apply(parent.Process.Pid)
+	// 设置资源限制, 将容器进程加入到各个subsystem挂载对应的cgroup中
+	// init进程还在等待配置, 失败时直接杀死, 不能让容器在没有资源和设备限制的情况下运行
+	if err := cgroupManager.Set(res); err != nil {
+		writePipe.Close()
+		parent.Process.Kill()
+		parent.Wait()
+		deleteContainerInfo(containerName)
+		container.DeleteWorkSpace(driver, volume, containerName)
+		return fmt.Errorf("Set cgroup of %s error %v", containerName, err)
+	}
+	if err := cgroupManager.Apply(parent.Process.Pid); err != nil {
+		writePipe.Close()
+		parent.Process.Kill()
+		parent.Wait()
+		deleteContainerInfo(containerName)
+		container.DeleteWorkSpace(driver, volume, containerName)
+		return fmt.Errorf("Apply cgroup of %s error %v", containerName, err)
+	}
 	// 对容器设置完限制之后, 初始化容器
 
 	// mntURL := "/root/mnt"
 	// rootURL := "/root/"
 	// container.DeleteWorkSpace(rootURL, mntURL, volume)
 
-	if nw != "" {
+	// 与宿主机或其它容器共享网络时不需要再配置网络
+	ip := ""
+	if nw != "" && namespaces.Get("net") != nil && namespaces.Get("net").Path == "" {
 		// 配置容器网络
 		network.Init()
 		containerInfo := &container.ContainerInfo{
@@ -68,26 +169,209 @@ func Run(tty bool, cmdArray []string, res *subsystems.ResourceConfig, containerN
 			PortMapping:	portmapping,
 		}
 		if err := network.Connect(nw, containerInfo); err != nil {
-			log.Errorf("Error Connect Network %v", err)
-			return
+			return fmt.Errorf("Error Connect Network %v", err)
 		}
+		ip = containerInfo.IPAddress
+	} else {
+		ip = sharedIPAddress(nsConf)
+	}
+	if ip != "" {
+		recordContainerIP(containerName, ip)
 	}
 
-	sendInitCommand(cmdArray, writePipe)
-
+	// 生成容器的 /etc/hosts, /etc/resolv.conf 和 /etc/hostname, 由init进程在pivotRoot之前bind到rootfs中
+	uid, gid := 0, 0
+	if idMappings != nil {
+		uid, gid = idMappings.RootPair()
+	}
+	bindMounts, err := container.SetupEtcFiles(containerName, envHostname, ip, dns, namespaces.Get("net") == nil, uid, gid)
+	if err != nil {
+		writePipe.Close()
+		parent.Process.Kill()
+		parent.Wait()
+		deleteContainerInfo(containerName)
+		container.DeleteWorkSpace(driver, volume, containerName)
+		return fmt.Errorf("Setup etc files error %v", err)
+	}
+	bindMounts = append(bindMounts, mounts...)
+
+	// 容器的namespace已经创建好, init进程还在等待配置, 此时运行prestart和createRuntime
+	state := &container.State{
+		OCIVersion:  container.OCIVersion,
+		ID:          containerName,
+		Status:      "created",
+		Pid:         parent.Process.Pid,
+		Bundle:      fmt.Sprintf(container.DefaultInfoLocation, containerName),
+		Annotations: config.Labels,
+	}
+	if err := container.RunHooks(append(hooks.Prestart, hooks.CreateRuntime...), state); err != nil {
+		writePipe.Close()
+		parent.Process.Kill()
+		parent.Wait()
+		deleteContainerInfo(containerName)
+		container.DeleteWorkSpace(driver, volume, containerName)
+		return fmt.Errorf("Run createRuntime hooks error %v", err)
+	}
+
+	initConfig := &container.InitConfig{
+		Args:            config.Cmd,
+		Capabilities:    capabilities,
+		Seccomp:         seccompConfig,
+		NoNewPrivileges: sec.NoNewPrivileges,
+		ReadonlyRootfs:  sec.ReadOnly,
+		ReadonlyTmpfs:   sec.ReadOnlyTmpfs,
+		Devices:         dev.Devices,
+		ShmSize:         dev.ShmSize,
+		UserNamespace:   idMappings != nil,
+		Console:         tty,
+		Cwd:             config.WorkingDir,
+		User:            config.User,
+		Env:             config.Env,
+		Hostname:        hostname,
+		CgroupNamespace: nsConf.PrivateCgroups,
+		BindMounts:      bindMounts,
+		Sysctls:         nsConf.Sysctls,
+	}
+	// privileged 容器与docker一致, 不屏蔽也不只读任何路径
+	if !sec.Privileged {
+		initConfig.MaskedPaths = container.DefaultMaskedPaths
+		initConfig.ReadonlyPaths = container.DefaultReadonlyPaths
+	}
+	sendInitConfig(initConfig, writePipe)
+
+	// poststart 在用户进程启动之后运行, init进程在exec之前失败时不运行
+	// 失败时依然等待前台容器退出并清理, 最后再把错误返回给调用者
+	var initErr error
+	if err := container.WaitExec(execSync); err != nil {
+		initErr = fmt.Errorf("Container init process error %v", err)
+	} else {
+		state.Status = container.RUNNING
+		if err := container.RunHooks(hooks.Poststart, state); err != nil {
+			log.Warnf("Run poststart hooks error %v", err)
+		}
+	}
 	
 	if tty {
+		restoreConsole := console.Proxy()
 		parent.Wait()
+		restoreConsole()
 		deleteContainerInfo(containerName)
-		container.DeleteWorkSpace(volume, containerName)
+		container.DeleteWorkSpace(driver, volume, containerName)
+		// 与OCI规范一致, poststop 在容器被删除之后运行
+		state.Status = container.STOP
+		if err := container.RunHooks(hooks.Poststop, state); err != nil {
+			log.Warnf("Run poststop hooks error %v", err)
+		}
 	}
+	return initErr
 }
 
-func sendInitCommand(cmdArray []string, writePipe *os.File) {
-	command := strings.Join(cmdArray, " ")
-	log.Infof("command all is %s", command)
-	writePipe.WriteString(command)
-	writePipe.Close()
+// 根据 --pid, --ipc, --uts, --net 和 --cgroupns 得到容器的namespace列表
+// mnt namespace 总是新建的, container:<name> 通过目标容器init进程的 /proc/<pid>/ns 加入
+func resolveNamespaces(nsConf *container.NamespaceConfig, userns bool) (container.Namespaces, error) {
+	namespaces := container.Namespaces{{Type: "mnt"}}
+	if userns {
+		namespaces = append(namespaces, container.Namespace{Type: "user"})
+	}
+	modes := []struct {
+		nsType string
+		mode   string
+	}{
+		{"pid", nsConf.Pid},
+		{"ipc", nsConf.Ipc},
+		{"uts", nsConf.Uts},
+		{"net", nsConf.Net},
+	}
+	// pod的成员容器加入pause进程的net, ipc和uts namespace
+	var podInfo *container.PodInfo
+	if nsConf.Pod != "" {
+		var err error
+		if podInfo, err = getPodInfoByName(nsConf.Pod); err != nil {
+			return nil, fmt.Errorf("Get pod %s info error %v", nsConf.Pod, err)
+		}
+		if podInfo.Status != container.RUNNING {
+			return nil, fmt.Errorf("Pod %s is not running", nsConf.Pod)
+		}
+	}
+	for _, m := range modes {
+		if podInfo != nil && m.nsType != "pid" {
+			namespaces = append(namespaces, container.Namespace{
+				Type: m.nsType,
+				Path: container.NamespacePath(podInfo.InfraPid, m.nsType),
+			})
+			continue
+		}
+		host, target, err := container.ParseNamespaceMode(m.mode)
+		if err != nil {
+			return nil, err
+		}
+		if host {
+			continue
+		}
+		ns := container.Namespace{Type: m.nsType}
+		if target != "" {
+			containerInfo, err := getContainerInfoByName(target)
+			if err != nil {
+				return nil, fmt.Errorf("Get container %s info error %v", target, err)
+			}
+			if containerInfo.Status != container.RUNNING {
+				return nil, fmt.Errorf("Container %s is not running", target)
+			}
+			ns.Path = container.NamespacePath(containerInfo.Pid, m.nsType)
+		}
+		namespaces = append(namespaces, ns)
+	}
+	if nsConf.PrivateCgroups {
+		namespaces = append(namespaces, container.Namespace{Type: "cgroup"})
+	}
+	return namespaces, nil
+}
+
+// 需要加入其它容器的namespace时, 在一个锁定的线程上setns之后再启动容器进程
+// 容器进程由这个线程clone出来, 会继承线程当前的namespace
+// 线程的namespace已经被修改, goroutine退出时不解锁, 由Go运行时直接销毁这个线程
+func startParent(parent *exec.Cmd, namespaces container.Namespaces) error {
+	if !namespaces.HasJoined() {
+		return parent.Start()
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		if err := namespaces.Join(); err != nil {
+			errCh <- err
+			return
+		}
+		errCh <- parent.Start()
+	}()
+	return <-errCh
+}
+
+// 根据 --security-opt seccomp=... 得到容器使用的seccomp profile
+// privileged 容器和 seccomp=unconfined 不安装过滤器
+// 没有系统调用表的架构上默认profile无法编译, 打印警告后不安装过滤器, 显式指定的profile仍然报错
+func loadSeccompProfile(sec *container.SecurityConfig) (*seccomp.Seccomp, error) {
+	if sec.Privileged || sec.SeccompProfile == seccomp.Unconfined {
+		return nil, nil
+	}
+	if sec.SeccompProfile == "" {
+		if !seccomp.Supported() {
+			log.Warnf("Seccomp is not supported on %s, running the container unconfined", runtime.GOARCH)
+			return nil, nil
+		}
+		return seccomp.DefaultProfile(), nil
+	}
+	return seccomp.LoadProfile(sec.SeccompProfile)
+}
+
+func sendInitConfig(initConfig *container.InitConfig, writePipe *os.File) {
+	defer writePipe.Close()
+	log.Infof("command all is %s", strings.Join(initConfig.Args, " "))
+	jsonBytes, err := json.Marshal(initConfig)
+	if err != nil {
+		log.Errorf("Marshal init config error %v", err)
+		return
+	}
+	writePipe.Write(jsonBytes)
 }
 
 func randStringBytes(n int) string {
@@ -100,11 +384,11 @@ func randStringBytes(n int) string {
 	return string(b)
 }
 
-func recordContainerInfo(containerPID int, commandArray []string, containerName string) (string, error) {
+func recordContainerInfo(containerPID int, config *v1.ImageConfig, containerName string, img *image.Image, capabilities []string, idMappings *container.IDMappings, hooks *container.Hooks, namespaces container.Namespaces, pod string, oomScoreAdj int, seccompConfig *seccomp.Seccomp, noNewPrivileges bool, storageDriver string) (string, error) {
 	// 首先生成10位数字的容器ID
 	id := randStringBytes(10)
 	createTime := time.Now().Format("2006-01-02 15:04:05")
-	command := strings.Join(commandArray, "")
+	command := strings.Join(config.Cmd, "")
 	// 如果没有指定容器名, 那么就叫"深海の女の子" (′゜ω。‵)
 	// 生成容器信息的结构体实例
 	containerInfo := &container.ContainerInfo {
@@ -114,6 +398,22 @@ func recordContainerInfo(containerPID int, commandArray []string, containerName
 		CreatedTime:	createTime,
 		Status:			container.RUNNING,
 		Name:			containerName,
+		Capabilities:	capabilities,
+		IDMappings:		idMappings,
+		Image:			img.Name,
+		ImageDigest:	img.Digest.String(),
+		StopSignal:		config.StopSignal,
+		Labels:			config.Labels,
+		Env:			config.Env,
+		Hooks:			hooks,
+		Namespaces:		namespaces,
+		Pod:			pod,
+		OomScoreAdj:	oomScoreAdj,
+		WorkingDir:		config.WorkingDir,
+		User:			config.User,
+		Seccomp:		seccompConfig,
+		NoNewPrivileges:	noNewPrivileges,
+		StorageDriver:	storageDriver,
 	}
 	
 	// 将容器信息的对象json序列化成字符串
@@ -150,6 +450,40 @@ func recordContainerInfo(containerPID int, commandArray []string, containerName
 	return containerName, nil
 }
 
+// 加入pod或者其它容器的网络时, 容器的IP就是pod或目标容器的IP
+func sharedIPAddress(nsConf *container.NamespaceConfig) string {
+	if nsConf.Pod != "" {
+		if podInfo, err := getPodInfoByName(nsConf.Pod); err == nil {
+			return podInfo.IPAddress
+		}
+		return ""
+	}
+	if _, target, _ := container.ParseNamespaceMode(nsConf.Net); target != "" {
+		if containerInfo, err := getContainerInfoByName(target); err == nil {
+			return containerInfo.IPAddress
+		}
+	}
+	return ""
+}
+
+// 网络配置完成之后把分配到的IP写入容器信息, 供 container:<name> 共享网络的容器使用
+func recordContainerIP(containerName, ip string) {
+	containerInfo, err := getContainerInfoByName(containerName)
+	if err != nil {
+		return
+	}
+	containerInfo.IPAddress = ip
+	jsonBytes, err := json.Marshal(containerInfo)
+	if err != nil {
+		log.Errorf("Json marshal %s error %v", containerName, err)
+		return
+	}
+	configFilePath := fmt.Sprintf(container.DefaultInfoLocation, containerName) + container.ConfigName
+	if err := ioutil.WriteFile(configFilePath, jsonBytes, 0622); err != nil {
+		log.Errorf("Write file %s error %v", configFilePath, err)
+	}
+}
+
 func deleteContainerInfo(containerName string) {
 	// 删除容器信息 
 	// /var/run/paddle/{{containerId}}
@@ -206,19 +540,27 @@ func logContainer(containerName string) {
 	logFileLocation := dirURL + container.ContainerLogFile
 	// 打开日志文件
 	file, err := os.Open(logFileLocation)
-	defer file.Close()
 	if err != nil {
 		log.Errorf("Log container open file %s error %v", logFileLocation, err)
 		return
 	}
-	// 将文件内的内容都读取出来
-	content, err := ioutil.ReadAll(file)
-	if err != nil {
-		log.Errorf("Log container read file %s error %v", logFileLocation, err)
-		return
+	defer file.Close()
+	// 每一行是一条json格式的日志, 根据stream字段分别输出到标准输出和标准错误
+	decoder := json.NewDecoder(file)
+	for {
+		var entry container.LogEntry
+		if err := decoder.Decode(&entry); err != nil {
+			if err != io.EOF {
+				log.Errorf("Log container read file %s error %v", logFileLocation, err)
+			}
+			return
+		}
+		if entry.Stream == "stderr" {
+			fmt.Fprint(os.Stderr, entry.Log)
+		} else {
+			fmt.Fprint(os.Stdout, entry.Log)
+		}
 	}
-	// 使用fmt.Fprint函数将读出来的内容都输入到标准输出, 也就是控制台上
-	fmt.Fprint(os.Stdout, string(content))
 }
 
 func GetContainerPidByName(containerName string) (string, error) {
@@ -237,56 +579,179 @@ func GetContainerPidByName(containerName string) (string, error) {
 	return containerInfo.Pid, nil
 }
 
-const ENV_EXEC_PID = "paddle_pid"
-const ENV_EXEC_CMD = "paddle_cmd"
-
-func ExecContainer(containerName string, comArray []string) {
+// 在容器中运行comArray, 返回命令的退出码, 命令被信号杀死时返回128+信号值
+// -d 时进程启动之后立即返回0
+func ExecContainer(containerName string, comArray []string, execConfig *container.ExecConfig) (int, error) {
 	// 根据传递过来的容器名获取宿主机对应的PID
-	pid, err := GetContainerPidByName(containerName)
+	containerInfo, err := getContainerInfoByName(containerName)
 	if err != nil {
-		log.Errorf("Exec container getContainerPidByName %s error %v", containerName, err)
-		return
+		return 0, fmt.Errorf("Exec container getContainerInfoByName %s error %v", containerName, err)
+	}
+	if containerInfo.Status != container.RUNNING {
+		return 0, fmt.Errorf("Container %s is not running", containerName)
+	}
+	pid := containerInfo.Pid
+	// exec进入的进程与容器init使用同一个capability集合
+	capMask, err := container.CapabilityMask(containerInfo.Capabilities)
+	if err != nil {
+		return 0, fmt.Errorf("Exec container capability mask error %v", err)
 	}
-	cmdStr := strings.Join(comArray, " ")
 	log.Infof("container pid %s", pid)
-	log.Infof("command %s", cmdStr)
-
-	// fork出一个进程, 获取环境变量
-	cmd := exec.Command("/proc/self/exe", "exec")
-	
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	log.Infof("command %v", comArray)
 
-	err = os.Setenv(ENV_EXEC_PID, pid)
+	// 没有指定时与容器的用户进程使用相同的用户和工作目录
+	userSpec := execConfig.User
+	if userSpec == "" {
+		userSpec = containerInfo.User
+	}
+	// 通过 /proc/<pid>/root 读取容器内的 /etc/passwd 和 /etc/group
+	execUser, err := container.GetExecUser(fmt.Sprintf("/proc/%s/root", pid), userSpec)
+	if err != nil {
+		return 0, err
+	}
+	cwd := execConfig.WorkingDir
+	if cwd == "" {
+		cwd = containerInfo.WorkingDir
+	}
+	if cwd == "" {
+		cwd = "/"
+	}
+	nsenterConfig := &container.NsenterConfig{
+		Pid:             pid,
+		Namespaces:      containerInfo.Namespaces.ExecOrder(),
+		Args:            comArray,
+		Cwd:             cwd,
+		Uid:             execUser.Uid,
+		Gid:             execUser.Gid,
+		Groups:          execUser.Sgids,
+		CapMask:         capMask,
+		NoNewPrivileges: containerInfo.NoNewPrivileges,
+	}
+
+	// fork出一个进程, nsenter从管道中读取目标容器的信息和要运行的命令, 之后是seccomp过滤器
+	// 这些信息不通过环境变量和参数传递, 容器内的进程看不到它们
+	cmd := exec.Command("/proc/self/exe", "nsenter")
+	readPipe, writePipe, err := container.NewPipe()
 	if err != nil {
-		log.Errorf("Set env error")
+		return 0, fmt.Errorf("New pipe error %v", err)
+	}
+	defer writePipe.Close()
+
+	// 每次exec都记录为一个会话, nsenter在 status 文件中写入命令的PID和退出码, 用于审计和 paddle exec kill
+	session := &container.ExecSession{
+		Id:        randStringBytes(10),
+		Container: containerName,
+		Command:   comArray,
+		User:      fmt.Sprintf("%d:%d", execUser.Uid, execUser.Gid),
+		Detached:  execConfig.Detach,
 	}
-	err = os.Setenv(ENV_EXEC_CMD, cmdStr)
+	statusFile, err := container.NewExecSession(session)
 	if err != nil {
-		log.Errorf("Set env error")
+		readPipe.Close()
+		return 0, fmt.Errorf("Create exec session error %v", err)
 	}
-	containerEnvs := getEnvsByPid(pid)
-	cmd.Env = append(os.Environ(), containerEnvs...)
+	defer statusFile.Close()
+	cmd.ExtraFiles = []*os.File{readPipe, statusFile}
 
-	if err := cmd.Run(); err != nil {
-		log.Errorf("Exec container %s error %v", containerName, err)
+	// 只使用容器配置的环境变量和 -e 指定的变量, 不继承调用者的环境
+	// 没有配置HOME时使用exec用户在容器内的home目录
+	defaultEnv := []string{"HOME=" + execUser.Home}
+	if execConfig.Tty {
+		defaultEnv = append(defaultEnv, "TERM=xterm")
 	}
-}
+	cmd.Env = container.MergeEnv(container.MergeEnv(defaultEnv, containerInfo.Env), execConfig.Env)
 
-func getEnvsByPid(pid string) []string  {
-	path := fmt.Sprintf("/proc/%s/environ", pid)
-	contentBytes, err := ioutil.ReadFile(path)
+	var console *container.Console
+	switch {
+	case execConfig.Tty:
+		if console, err = container.NewConsole(); err != nil {
+			return 0, err
+		}
+		cmd.Stdin = console.Slave
+		cmd.Stdout = console.Slave
+		cmd.Stderr = console.Slave
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+	case execConfig.Detach:
+		// 后台运行的进程脱离当前终端, 标准输入输出为 /dev/null
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	default:
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+	}
+
+	if err := cmd.Start(); err != nil {
+		readPipe.Close()
+		return 0, fmt.Errorf("Exec container %s error %v", containerName, err)
+	}
+	readPipe.Close()
+	statusFile.Close()
+	session.Pid = cmd.Process.Pid
+	if err := session.Save(); err != nil {
+		log.Errorf("Save exec session %s error %v", session.Id, err)
+	}
+	// 先把nsenter加入容器的cgroup, 再发送配置让它继续, 这样用户进程从一开始就受到容器的资源限制
+	// 加入失败时nsenter还在等待配置, 直接杀死它, 不能让进程逃出容器的限制
+	if err := cgroups.NewCgroupManager(container.ContainerCgroupPath(containerName, containerInfo.Pod)).Apply(cmd.Process.Pid); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return 0, fmt.Errorf("Join cgroup of %s error %v", containerName, err)
+	}
+	// nsenter还在等待配置, 此时设置的oom_score_adj会被用户进程继承, paddle exec自身保持不变
+	if err := container.SetOomScoreAdj(strconv.Itoa(cmd.Process.Pid), containerInfo.OomScoreAdj); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return 0, err
+	}
+	if _, err := writePipe.Write(nsenterConfig.Encode()); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return 0, fmt.Errorf("Send exec config error %v", err)
+	}
+	if err := seccomp.WriteFilter(writePipe, containerInfo.Seccomp, containerInfo.Capabilities); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return 0, fmt.Errorf("Send seccomp filter error %v", err)
+	}
+	writePipe.Close()
+	if execConfig.Detach {
+		cmd.Process.Release()
+		fmt.Println(session.Id)
+		return 0, nil
+	}
+	if console != nil {
+		console.Slave.Close()
+		restoreConsole := console.Proxy()
+		defer restoreConsole()
+	}
+
+	// 终端的Ctrl-C和Ctrl-\ 会直接发给容器中的进程, 这里只需要避免paddle exec自己退出
+	// 其它信号转发给nsenter, 再由它转发给容器中的进程
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigs)
+	go func() {
+		for sig := range sigs {
+			if sig == syscall.SIGTERM || sig == syscall.SIGHUP {
+				cmd.Process.Signal(sig)
+			}
+		}
+	}()
+
+	err = cmd.Wait()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		status := exitErr.Sys().(syscall.WaitStatus)
+		if status.Signaled() {
+			return 128 + int(status.Signal()), nil
+		}
+		return status.ExitStatus(), nil
+	}
 	if err != nil {
-		log.Errorf("Read file %s error %v", path, err)
-		return nil
+		return 0, fmt.Errorf("Exec container %s error %v", containerName, err)
 	}
-	// env spit by \u0000
-	envs := strings.Split(string(contentBytes), "\u0000")
-	return envs
+	return 0, nil
 }
 
-
 // stopContainer的主要步骤
 // 1. 获取容器PID
 // 2. 对该PID发送kill信号
@@ -294,28 +759,29 @@ func getEnvsByPid(pid string) []string  {
 // 4. 重新写入存储容器信息的文件
 
 func stopContainer(containerName string) {
-	// 根据容器名获取对应的主进程PID
-	pid, err := GetContainerPidByName(containerName)
+	// 根据容器名获取对应的信息对象
+	containerInfo, err := getContainerInfoByName(containerName)
 	if err != nil {
-		log.Errorf("Get contaienr pid by name %s error %v", containerName, err)
+		log.Errorf("Get container %s info error %v", containerName, err)
 		return
 	}
+	pid := containerInfo.Pid
 	// 将string类型的PID转化成int类型
 	pidInt, err := strconv.Atoi(pid)
 	if err != nil {
 		log.Errorf("Conver pid from string to int error %v", err)
 		return
 	}
-	// 系统调用kill可以发送信号给进程, 通过传递syscall.SIGTERM信号, 去杀掉容器进程
-	if err := syscall.Kill(pidInt, syscall.SIGTERM); err != nil {
-		log.Errorf("Stop container %s error %v", containerName, err)
-		return
+	// 系统调用kill可以发送信号给进程, 默认通过传递syscall.SIGTERM信号, 去杀掉容器进程, 镜像可以通过StopSignal指定其它信号
+	stopSignal := syscall.SIGTERM
+	if containerInfo.StopSignal != "" {
+		if stopSignal, err = container.ParseSignal(containerInfo.StopSignal); err != nil {
+			log.Errorf("Parse stop signal of %s error %v", containerName, err)
+			return
+		}
 	}
-
-	// 根据容器名获取对应的信息对象
-	containerInfo, err := getContainerInfoByName(containerName)
-	if err != nil {
-		log.Errorf("Get container %s info error %v", containerName, err)
+	if err := syscall.Kill(pidInt, stopSignal); err != nil {
+		log.Errorf("Stop container %s error %v", containerName, err)
 		return
 	}
 
@@ -364,10 +830,29 @@ func removeContainer(containerName string) {
 		log.Errorf("Couldn't remove running container")
 		return
 	}
+	driver, err := storage.New(containerInfo.StorageDriver)
+	if err != nil {
+		log.Errorf("Get storage driver of %s error %v", containerName, err)
+		return
+	}
 	dirURL := fmt.Sprintf(container.DefaultInfoLocation, containerName)
 	if err := os.RemoveAll(dirURL); err != nil {
 		log.Errorf("Remove file %s error %v", dirURL, err)
 		return
 	}
-	container.DeleteWorkSpace(containerInfo.Volume, containerName)
+	container.DeleteWorkSpace(driver, containerInfo.Volume, containerName)
+
+	// 与OCI规范一致, poststop 在容器被删除之后运行, 后台运行的容器也在这里运行
+	if containerInfo.Hooks != nil {
+		state := &container.State{
+			OCIVersion:  container.OCIVersion,
+			ID:          containerName,
+			Status:      container.STOP,
+			Bundle:      dirURL,
+			Annotations: containerInfo.Labels,
+		}
+		if err := container.RunHooks(containerInfo.Hooks.Poststop, state); err != nil {
+			log.Warnf("Run poststop hooks error %v", err)
+		}
+	}
 }
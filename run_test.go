@@ -0,0 +1,458 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/IsolationWyn/paddle/archive"
+	"github.com/IsolationWyn/paddle/cgroups/subsystems"
+	"github.com/IsolationWyn/paddle/container"
+	"github.com/IsolationWyn/paddle/image"
+	"github.com/IsolationWyn/paddle/storage"
+	"github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// 容器的init进程和日志进程通过 /proc/self/exe 启动, 在测试中执行的是测试程序本身
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && (os.Args[1] == "init" || os.Args[1] == "logger") {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// 用宿主机上的 sh, id 和 sleep 以及它们依赖的动态库组成一个最小的镜像
+func buildTestImage(t *testing.T, dir string) {
+	rootfs := filepath.Join(dir, "rootfs")
+	libRe := regexp.MustCompile(`(/\S+)`)
+	for _, name := range []string{"sh", "id", "sleep"} {
+		bin, err := exec.LookPath(name)
+		if err != nil {
+			t.Skipf("%s not found", name)
+		}
+		output, err := exec.Command("ldd", bin).Output()
+		if err != nil && !strings.Contains(string(output), "not a dynamic") {
+			t.Skipf("ldd %s: %v", bin, err)
+		}
+		files := append([]string{bin}, libRe.FindAllString(string(output), -1)...)
+		for i, file := range files {
+			content, err := ioutil.ReadFile(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dst := filepath.Join(rootfs, file)
+			if i == 0 {
+				dst = filepath.Join(rootfs, "bin", name)
+			}
+			os.MkdirAll(filepath.Dir(dst), 0755)
+			if err := ioutil.WriteFile(dst, content, 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	os.MkdirAll(filepath.Join(rootfs, "etc"), 0755)
+	ioutil.WriteFile(filepath.Join(rootfs, "etc/passwd"), []byte("root:x:0:0:root:/root:/bin/sh\n"), 0644)
+	ioutil.WriteFile(filepath.Join(rootfs, "etc/group"), []byte("root:x:0:\n"), 0644)
+
+	f, err := os.Create(filepath.Join(image.LegacyRoot, "tiny.tar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := archive.Tar(rootfs, f, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 把镜像, 存储和容器的目录都换到临时目录中, 返回临时目录和恢复原设置的函数
+func setupTestRoot(t *testing.T) (string, func()) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	dir, err := ioutil.TempDir("", "paddle-run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy, imageRoot, storageRoot := image.LegacyRoot, image.DefaultRoot, storage.StorageRoot
+	mnt, subuid, subgid := container.MntUrl, container.SubuidFile, container.SubgidFile
+	restore := func() {
+		image.LegacyRoot, image.DefaultRoot, storage.StorageRoot = legacy, imageRoot, storageRoot
+		container.MntUrl, container.SubuidFile, container.SubgidFile = mnt, subuid, subgid
+		os.RemoveAll(dir)
+	}
+	image.LegacyRoot = dir
+	image.DefaultRoot = filepath.Join(dir, "image")
+	storage.StorageRoot = filepath.Join(dir, "storage")
+	container.MntUrl = filepath.Join(dir, "mnt", "%s")
+	container.SubuidFile = filepath.Join(dir, "subuid")
+	container.SubgidFile = filepath.Join(dir, "subgid")
+	buildTestImage(t, dir)
+	return dir, restore
+}
+
+// 从临时的镜像存储中取出 buildTestImage 生成的镜像
+func testImage(t *testing.T) *image.Image {
+	img, err := image.NewStore(image.DefaultRoot).Get("tiny")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+// 等待容器中的命令写入 /done
+func waitDone(rootfs string) {
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(filepath.Join(rootfs, "done")); err == nil {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// 把 CapEff 写入 /cap 的命令
+const writeCapEff = "while read k v; do [ $k = CapEff: ] && echo $v > /cap; done < /proc/self/status"
+
+func TestRunCapDropAll(t *testing.T) {
+	_, restore := setupTestRoot(t)
+	defer restore()
+	driver, err := storage.New("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		capAdd   []string
+		expected string
+	}{
+		{nil, "0000000000000000"},
+		{[]string{"NET_BIND_SERVICE"}, "0000000000000400"},
+	}
+	for i, tc := range testCases {
+		containerName := fmt.Sprintf("capdrop-test-%d-%d", os.Getpid(), i)
+		config := &v1.ImageConfig{
+			Cmd: []string{"/bin/sh", "-c", writeCapEff + "; : > /done"},
+		}
+		if err := Run(false, false, config, &subsystems.ResourceConfig{}, &container.SecurityConfig{CapDrop: []string{"ALL"}, CapAdd: tc.capAdd},
+			&container.DeviceConfig{ShmSize: container.DefaultShmSize}, &container.Hooks{}, &container.NamespaceConfig{},
+			&container.DNSConfig{}, nil, driver, containerName, testImage(t), "", "", nil); err != nil {
+			t.Fatal(err)
+		}
+
+		rootfs := fmt.Sprintf(container.MntUrl, containerName)
+		waitDone(rootfs)
+		capEff, err := ioutil.ReadFile(filepath.Join(rootfs, "cap"))
+		stopContainer(containerName)
+		removeContainer(containerName)
+		if err != nil {
+			t.Fatalf("cap-add %v: container did not run: %v", tc.capAdd, err)
+		}
+		if strings.TrimSpace(string(capEff)) != tc.expected {
+			t.Fatalf("cap-add %v: expected CapEff %s, got %s", tc.capAdd, tc.expected, capEff)
+		}
+	}
+}
+
+func TestExecCapDropAll(t *testing.T) {
+	_, restore := setupTestRoot(t)
+	defer restore()
+	driver, err := storage.New("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	containerName := fmt.Sprintf("exec-test-%d", os.Getpid())
+	config := &v1.ImageConfig{
+		Cmd: []string{"/bin/sh", "-c", ": > /done; sleep 100"},
+	}
+	if err := Run(false, false, config, &subsystems.ResourceConfig{}, &container.SecurityConfig{CapDrop: []string{"ALL"}, CapAdd: []string{"NET_BIND_SERVICE"}},
+		&container.DeviceConfig{ShmSize: container.DefaultShmSize}, &container.Hooks{}, &container.NamespaceConfig{},
+		&container.DNSConfig{}, nil, driver, containerName, testImage(t), "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		stopContainer(containerName)
+		removeContainer(containerName)
+	}()
+	rootfs := fmt.Sprintf(container.MntUrl, containerName)
+	waitDone(rootfs)
+
+	// exec进入的进程需要切换用户之后再收缩capability, 容器没有CAP_SETGID和CAP_SETUID时也能运行
+	code, err := ExecContainer(containerName, []string{"/bin/sh", "-c", writeCapEff + "; exit 0"}, &container.ExecConfig{})
+	if err != nil || code != 0 {
+		t.Fatalf("exec exited with %d: %v", code, err)
+	}
+	capEff, _ := ioutil.ReadFile(filepath.Join(rootfs, "cap"))
+	if strings.TrimSpace(string(capEff)) != "0000000000000400" {
+		t.Fatalf("expected CapEff 0000000000000400 in exec, got %q", capEff)
+	}
+}
+
+func TestExecJoinsCgroup(t *testing.T) {
+	_, restore := setupTestRoot(t)
+	defer restore()
+	driver, err := storage.New("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	containerName := fmt.Sprintf("exec-cgroup-test-%d", os.Getpid())
+	config := &v1.ImageConfig{
+		Cmd: []string{"/bin/sh", "-c", ": > /done; sleep 100"},
+	}
+	if err := Run(false, false, config, &subsystems.ResourceConfig{}, &container.SecurityConfig{},
+		&container.DeviceConfig{ShmSize: container.DefaultShmSize}, &container.Hooks{}, &container.NamespaceConfig{},
+		&container.DNSConfig{}, nil, driver, containerName, testImage(t), "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		stopContainer(containerName)
+		removeContainer(containerName)
+	}()
+	rootfs := fmt.Sprintf(container.MntUrl, containerName)
+	waitDone(rootfs)
+
+	code, err := ExecContainer(containerName, []string{"/bin/sh", "-c", "while read l; do echo $l; done < /proc/self/cgroup > /cgroup"}, &container.ExecConfig{})
+	if err != nil || code != 0 {
+		t.Fatalf("exec exited with %d: %v", code, err)
+	}
+	cgroup, _ := ioutil.ReadFile(filepath.Join(rootfs, "cgroup"))
+	if !strings.Contains(string(cgroup), ":memory:/"+containerName+"\n") {
+		t.Fatalf("exec did not join the memory cgroup of the container:\n%s", cgroup)
+	}
+
+	// 容器的cgroup不存在时不能运行命令
+	containerInfo, err := getContainerInfoByName(containerName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	containerInfo.Pod = "missing"
+	content, _ := json.Marshal(containerInfo)
+	configFile := fmt.Sprintf(container.DefaultInfoLocation, containerName) + container.ConfigName
+	if err := ioutil.WriteFile(configFile, content, 0622); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ExecContainer(containerName, []string{"/bin/sh", "-c", ": > /escaped"}, &container.ExecConfig{}); err == nil {
+		t.Fatal("expected error when the cgroup of the container is missing")
+	}
+	if _, err := os.Stat(filepath.Join(rootfs, "escaped")); err == nil {
+		t.Fatal("exec ran outside of the cgroup of the container")
+	}
+	containerInfo.Pod = ""
+	content, _ = json.Marshal(containerInfo)
+	ioutil.WriteFile(configFile, content, 0622)
+}
+
+func TestExecOomScoreAdj(t *testing.T) {
+	_, restore := setupTestRoot(t)
+	defer restore()
+	driver, err := storage.New("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	containerName := fmt.Sprintf("exec-oom-test-%d", os.Getpid())
+	config := &v1.ImageConfig{
+		Cmd: []string{"/bin/sh", "-c", ": > /done; sleep 100"},
+	}
+	if err := Run(false, false, config, &subsystems.ResourceConfig{OomScoreAdj: 500}, &container.SecurityConfig{},
+		&container.DeviceConfig{ShmSize: container.DefaultShmSize}, &container.Hooks{}, &container.NamespaceConfig{},
+		&container.DNSConfig{}, nil, driver, containerName, testImage(t), "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		stopContainer(containerName)
+		removeContainer(containerName)
+	}()
+	rootfs := fmt.Sprintf(container.MntUrl, containerName)
+	waitDone(rootfs)
+
+	before, _ := ioutil.ReadFile("/proc/self/oom_score_adj")
+	code, err := ExecContainer(containerName, []string{"/bin/sh", "-c", "read v < /proc/self/oom_score_adj; echo $v > /oom"}, &container.ExecConfig{})
+	if err != nil || code != 0 {
+		t.Fatalf("exec exited with %d: %v", code, err)
+	}
+	if oom, _ := ioutil.ReadFile(filepath.Join(rootfs, "oom")); strings.TrimSpace(string(oom)) != "500" {
+		t.Fatalf("expected oom_score_adj 500 in exec, got %q", oom)
+	}
+	// paddle exec 自身的值不受影响
+	if after, _ := ioutil.ReadFile("/proc/self/oom_score_adj"); string(after) != string(before) {
+		t.Fatalf("oom_score_adj of the caller changed from %q to %q", before, after)
+	}
+}
+
+// 容器启动之后镜像名被指向其它镜像, commit仍然以容器实际使用的镜像为父镜像
+func TestCommitAfterRetag(t *testing.T) {
+	dir, restore := setupTestRoot(t)
+	defer restore()
+	driver, err := storage.New("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := testImage(t)
+	containerName := fmt.Sprintf("commit-test-%d", os.Getpid())
+	config := &v1.ImageConfig{
+		Cmd: []string{"/bin/sh", "-c", ": > /done"},
+	}
+	if err := Run(false, false, config, &subsystems.ResourceConfig{}, &container.SecurityConfig{},
+		&container.DeviceConfig{ShmSize: container.DefaultShmSize}, &container.Hooks{}, &container.NamespaceConfig{},
+		&container.DNSConfig{}, nil, driver, containerName, img, "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		stopContainer(containerName)
+		removeContainer(containerName)
+	}()
+	waitDone(fmt.Sprintf(container.MntUrl, containerName))
+
+	store := image.NewStore(image.DefaultRoot)
+	other := filepath.Join(dir, "other.tar")
+	if err := writeLayer(filepath.Join(dir, "rootfs", "etc"), nil, nil, other); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Commit("tiny", nil, other, v1.ImageConfig{}, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := commitContainer(containerName, "snapshot", nil); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := store.Get("snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers := snapshot.Manifest.Layers
+	if len(layers) != len(img.Manifest.Layers)+1 || layers[0].Digest != img.Manifest.Layers[0].Digest {
+		t.Fatalf("expected snapshot on top of %v, got %v", img.Manifest.Layers, layers)
+	}
+}
+
+func TestRunRemappedContainer(t *testing.T) {
+	if _, err := os.Stat("/proc/self/ns/user"); err != nil {
+		t.Skip("user namespace not supported")
+	}
+	_, restore := setupTestRoot(t)
+	defer restore()
+	ioutil.WriteFile(container.SubuidFile, []byte("root:200000:65536\n"), 0644)
+	ioutil.WriteFile(container.SubgidFile, []byte("root:200000:65536\n"), 0644)
+
+	driver, err := storage.New("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	containerName := fmt.Sprintf("userns-test-%d", os.Getpid())
+	config := &v1.ImageConfig{
+		Cmd: []string{"/bin/sh", "-c", "id -u > /uid; " + writeCapEff + "; : > /done"},
+	}
+	if err := Run(false, false, config, &subsystems.ResourceConfig{}, &container.SecurityConfig{UsernsRemap: "root"},
+		&container.DeviceConfig{ShmSize: container.DefaultShmSize}, &container.Hooks{}, &container.NamespaceConfig{},
+		&container.DNSConfig{}, nil, driver, containerName, testImage(t), "", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		stopContainer(containerName)
+		removeContainer(containerName)
+	}()
+
+	rootfs := fmt.Sprintf(container.MntUrl, containerName)
+	waitDone(rootfs)
+	uid, err := ioutil.ReadFile(filepath.Join(rootfs, "uid"))
+	if err != nil {
+		t.Fatalf("container did not run: %v", err)
+	}
+	if strings.TrimSpace(string(uid)) != "0" {
+		t.Fatalf("expected uid 0 in container, got %s", uid)
+	}
+	capEff, _ := ioutil.ReadFile(filepath.Join(rootfs, "cap"))
+	if strings.Trim(strings.TrimSpace(string(capEff)), "0") == "" {
+		t.Fatalf("container root has no capabilities: %q", capEff)
+	}
+	// 镜像中的文件和容器内root创建的文件在宿主机上都属于映射之后的uid
+	for _, file := range []string{"bin/sh", "uid"} {
+		var st syscall.Stat_t
+		if err := syscall.Stat(filepath.Join(rootfs, file), &st); err != nil {
+			t.Fatal(err)
+		}
+		if st.Uid != 200000 || st.Gid != 200000 {
+			t.Fatalf("expected owner 200000:200000 of %s on host, got %d:%d", file, st.Uid, st.Gid)
+		}
+	}
+
+	// 提交时属主还原成容器内的id
+	containerInfo, err := getContainerInfoByName(containerName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff, err := driver.Diff(containerName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layerTar := filepath.Join(image.LegacyRoot, "layer.tar")
+	if err := writeLayer(rootfs, diff, containerInfo.IDMappings, layerTar); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(layerTar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Uid != 0 || hdr.Gid != 0 {
+			t.Fatalf("expected owner 0:0 of %s in layer, got %d:%d", hdr.Name, hdr.Uid, hdr.Gid)
+		}
+	}
+}
+
+func TestDebugTargetExited(t *testing.T) {
+	dir, err := ioutil.TempDir("", "paddle-debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(location string) { container.DefaultInfoLocation = location }(container.DefaultInfoLocation)
+	container.DefaultInfoLocation = dir + "/%s/"
+
+	// 容器信息还是 running, 但init进程已经退出
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skip(err)
+	}
+	writeInfo := func(pid int) {
+		info := &container.ContainerInfo{Name: "target", Pid: fmt.Sprint(pid), Status: container.RUNNING}
+		content, _ := json.Marshal(info)
+		os.MkdirAll(fmt.Sprintf(container.DefaultInfoLocation, "target"), 0755)
+		if err := ioutil.WriteFile(fmt.Sprintf(container.DefaultInfoLocation, "target")+container.ConfigName, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeInfo(cmd.Process.Pid)
+	if err := checkDebugTarget("target"); err == nil {
+		t.Fatal("expected an error for an exited target")
+	}
+	writeInfo(os.Getpid())
+	if err := checkDebugTarget("target"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 无法加入目标容器的namespace时 Run 把错误返回给调用者
+	err = Run(false, false, &v1.ImageConfig{Cmd: []string{"sh"}}, &subsystems.ResourceConfig{}, &container.SecurityConfig{},
+		&container.DeviceConfig{}, &container.Hooks{}, &container.NamespaceConfig{Pid: "container:missing"},
+		&container.DNSConfig{}, nil, nil, "debug", nil, "", "", nil)
+	if err == nil {
+		t.Fatal("expected Run to fail for a missing target")
+	}
+}
@@ -0,0 +1,313 @@
+package seccomp
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// seccomp过滤器的返回值, 对应 include/uapi/linux/seccomp.h
+const (
+	retKillProcess = 0x80000000
+	retKillThread  = 0x00000000
+	retTrap        = 0x00030000
+	retErrno       = 0x00050000
+	retTrace       = 0x7ff00000
+	retLog         = 0x7ffc0000
+	retAllow       = 0x7fff0000
+)
+
+// struct seccomp_data 中各字段的偏移
+const (
+	offsetNr   = 0
+	offsetArch = 4
+	offsetArgs = 16
+)
+
+// 跳转目标的占位符, 在规则块生成完之后再换算成相对偏移
+const (
+	labelFail  = -1 // 规则不匹配, 跳到下一条规则
+	labelMatch = -2 // 规则匹配, 跳到本规则块末尾的ret指令
+)
+
+type instruction struct {
+	code   uint16
+	jt, jf int
+	k      uint32
+}
+
+// 一条规则对应的指令块, 跳转目标是块内的绝对下标或者上面的占位符
+type block struct {
+	insns []instruction
+}
+
+func (b *block) next() int {
+	return len(b.insns) + 1
+}
+
+func (b *block) stmt(code uint16, k uint32) {
+	b.insns = append(b.insns, instruction{code: code, k: k})
+}
+
+func (b *block) jump(code uint16, k uint32, jt, jf int) {
+	b.insns = append(b.insns, instruction{code: code, jt: jt, jf: jf, k: k})
+}
+
+// 把seccomp profile编译成cBPF程序
+// 程序结构:
+// 1. 检查架构, 非本机架构直接杀掉进程
+// 2. 拒绝 x32 ABI 的系统调用, 避免绕过规则, 只有x86_64有这一步
+// 3. 依次匹配每条规则, 第一条匹配的规则决定返回值
+// 4. 都不匹配时返回默认动作
+func Compile(config *Seccomp, caps []string) ([]unix.SockFilter, error) {
+	if nativeArch == 0 {
+		return nil, fmt.Errorf("Seccomp is not supported on %s", runtime.GOARCH)
+	}
+	defaultRet, err := actionToRet(config.DefaultAction, config.DefaultErrnoRet)
+	if err != nil {
+		return nil, err
+	}
+
+	var filter []unix.SockFilter
+	filter = append(filter,
+		bpfStmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, offsetArch),
+		bpfJump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, nativeArch, 1, 0),
+		bpfStmt(unix.BPF_RET|unix.BPF_K, retKillProcess),
+		bpfStmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, offsetNr),
+	)
+	if x32SyscallBit != 0 {
+		filter = append(filter,
+			bpfJump(unix.BPF_JMP|unix.BPF_JGE|unix.BPF_K, x32SyscallBit, 0, 1),
+			bpfStmt(unix.BPF_RET|unix.BPF_K, retErrno|uint32(syscall.EPERM)),
+		)
+	}
+
+	// 累加器中是否仍然是系统调用号, 带参数的规则会覆盖累加器
+	accIsNr := true
+	for _, call := range config.Syscalls {
+		if !ruleApplies(call, caps) {
+			continue
+		}
+		ret, err := actionToRet(call.Action, call.ErrnoRet)
+		if err != nil {
+			return nil, err
+		}
+		names := append([]string{}, call.Names...)
+		if call.Name != "" {
+			names = append(names, call.Name)
+		}
+		for _, name := range names {
+			nr, ok := syscallTable[name]
+			if !ok {
+				// profile中可能包含其它架构或者更新内核的系统调用, 与libseccomp一样直接忽略
+				continue
+			}
+			b, err := buildBlock(nr, call.Args, ret, !accIsNr)
+			if err != nil {
+				return nil, fmt.Errorf("Syscall %s %v", name, err)
+			}
+			insns, err := b.resolve()
+			if err != nil {
+				return nil, fmt.Errorf("Syscall %s %v", name, err)
+			}
+			filter = append(filter, insns...)
+			accIsNr = len(call.Args) == 0
+		}
+	}
+	filter = append(filter, bpfStmt(unix.BPF_RET|unix.BPF_K, defaultRet))
+
+	if len(filter) > unix.BPF_MAXINSNS {
+		return nil, fmt.Errorf("Seccomp filter too long: %d instructions", len(filter))
+	}
+	return filter, nil
+}
+
+// 判断规则的 includes/excludes 条件是否满足
+func ruleApplies(call *Syscall, caps []string) bool {
+	capSet := make(map[string]bool)
+	for _, c := range caps {
+		capSet[strings.ToUpper(c)] = true
+	}
+	for _, c := range call.Includes.Caps {
+		if !capSet[strings.ToUpper(c)] {
+			return false
+		}
+	}
+	for _, c := range call.Excludes.Caps {
+		if capSet[strings.ToUpper(c)] {
+			return false
+		}
+	}
+	if len(call.Includes.Arches) > 0 && !inSlice(call.Includes.Arches, runtime.GOARCH) {
+		return false
+	}
+	if inSlice(call.Excludes.Arches, runtime.GOARCH) {
+		return false
+	}
+	return true
+}
+
+func inSlice(slice []string, s string) bool {
+	for _, item := range slice {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func actionToRet(action Action, errnoRet *uint) (uint32, error) {
+	data := uint32(syscall.EPERM)
+	if errnoRet != nil {
+		data = uint32(*errnoRet)
+	}
+	switch action {
+	case ActKill, ActKillThread:
+		return retKillThread, nil
+	case ActKillProcess:
+		return retKillProcess, nil
+	case ActTrap:
+		return retTrap, nil
+	case ActErrno:
+		return retErrno | (data & 0xffff), nil
+	case ActTrace:
+		return retTrace | (data & 0xffff), nil
+	case ActLog:
+		return retLog, nil
+	case ActAllow:
+		return retAllow, nil
+	}
+	return 0, fmt.Errorf("Unknown seccomp action %q", action)
+}
+
+// 生成一条规则的指令块: 比较系统调用号, 再依次比较每个参数, 全部满足时执行ret
+func buildBlock(nr int, args []*Arg, ret uint32, loadNr bool) (*block, error) {
+	b := &block{}
+	if loadNr {
+		b.stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, offsetNr)
+	}
+	b.jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, uint32(nr), b.next(), labelFail)
+
+	for _, arg := range args {
+		if arg.Index > 5 {
+			return nil, fmt.Errorf("invalid argument index %d", arg.Index)
+		}
+		if err := b.compareArg(arg); err != nil {
+			return nil, err
+		}
+	}
+	b.stmt(unix.BPF_RET|unix.BPF_K, ret)
+	return b, nil
+}
+
+// 系统调用参数是64位的, cBPF只能按32位比较, 所以先比较高32位再比较低32位
+// x86_64 是小端序, 低32位在前
+func (b *block) compareArg(arg *Arg) error {
+	lo := uint32(offsetArgs + 8*arg.Index)
+	hi := lo + 4
+	vlo, vhi := uint32(arg.Value), uint32(arg.Value>>32)
+	ld := uint16(unix.BPF_LD | unix.BPF_W | unix.BPF_ABS)
+	jeq := uint16(unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K)
+	jgt := uint16(unix.BPF_JMP | unix.BPF_JGT | unix.BPF_K)
+	jge := uint16(unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K)
+	and := uint16(unix.BPF_ALU | unix.BPF_AND | unix.BPF_K)
+
+	// pass 表示当前参数条件满足, 继续比较下一个参数
+	start := len(b.insns)
+	switch arg.Op {
+	case OpEqualTo:
+		pass := start + 4
+		b.stmt(ld, hi)
+		b.jump(jeq, vhi, b.next(), labelFail)
+		b.stmt(ld, lo)
+		b.jump(jeq, vlo, pass, labelFail)
+	case OpNotEqual:
+		pass := start + 4
+		b.stmt(ld, hi)
+		b.jump(jeq, vhi, b.next(), pass)
+		b.stmt(ld, lo)
+		b.jump(jeq, vlo, labelFail, pass)
+	case OpMaskedEqual:
+		pass := start + 6
+		mlo, mhi := vlo, vhi
+		wlo, whi := uint32(arg.ValueTwo), uint32(arg.ValueTwo>>32)
+		b.stmt(ld, hi)
+		b.stmt(and, mhi)
+		b.jump(jeq, whi, b.next(), labelFail)
+		b.stmt(ld, lo)
+		b.stmt(and, mlo)
+		b.jump(jeq, wlo, pass, labelFail)
+	case OpGreaterThan, OpGreaterEqual:
+		pass := start + 5
+		b.stmt(ld, hi)
+		b.jump(jgt, vhi, pass, b.next())
+		b.jump(jeq, vhi, b.next(), labelFail)
+		b.stmt(ld, lo)
+		if arg.Op == OpGreaterThan {
+			b.jump(jgt, vlo, pass, labelFail)
+		} else {
+			b.jump(jge, vlo, pass, labelFail)
+		}
+	case OpLessThan, OpLessEqual:
+		pass := start + 5
+		b.stmt(ld, hi)
+		b.jump(jgt, vhi, labelFail, b.next())
+		b.jump(jeq, vhi, b.next(), pass)
+		b.stmt(ld, lo)
+		if arg.Op == OpLessThan {
+			b.jump(jge, vlo, labelFail, pass)
+		} else {
+			b.jump(jgt, vlo, labelFail, pass)
+		}
+	default:
+		return fmt.Errorf("unknown operator %q", arg.Op)
+	}
+	return nil
+}
+
+// 把块内的绝对下标和占位符换算成cBPF的相对跳转偏移
+func (b *block) resolve() ([]unix.SockFilter, error) {
+	match := len(b.insns) - 1
+	fail := len(b.insns)
+	var insns []unix.SockFilter
+	for i, insn := range b.insns {
+		if insn.code&0x07 != unix.BPF_JMP {
+			insns = append(insns, bpfStmt(insn.code, insn.k))
+			continue
+		}
+		offset := func(target int) (uint8, error) {
+			switch target {
+			case labelFail:
+				target = fail
+			case labelMatch:
+				target = match
+			}
+			rel := target - (i + 1)
+			if rel < 0 || rel > 255 {
+				return 0, fmt.Errorf("jump offset %d out of range", rel)
+			}
+			return uint8(rel), nil
+		}
+		jt, err := offset(insn.jt)
+		if err != nil {
+			return nil, err
+		}
+		jf, err := offset(insn.jf)
+		if err != nil {
+			return nil, err
+		}
+		insns = append(insns, bpfJump(insn.code, insn.k, jt, jf))
+	}
+	return insns, nil
+}
+
+func bpfStmt(code uint16, k uint32) unix.SockFilter {
+	return unix.SockFilter{Code: code, K: k}
+}
+
+func bpfJump(code uint16, k uint32, jt, jf uint8) unix.SockFilter {
+	return unix.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+}
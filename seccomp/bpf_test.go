@@ -0,0 +1,131 @@
+package seccomp
+
+import (
+	"encoding/binary"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// 用一个最小的cBPF解释器在用户态执行编译出来的过滤器
+func runFilter(t *testing.T, filter []unix.SockFilter, arch uint32, nr int, args ...uint64) uint32 {
+	data := make([]byte, 64)
+	binary.LittleEndian.PutUint32(data[offsetNr:], uint32(nr))
+	binary.LittleEndian.PutUint32(data[offsetArch:], arch)
+	for i, arg := range args {
+		binary.LittleEndian.PutUint64(data[offsetArgs+8*i:], arg)
+	}
+
+	var acc uint32
+	for pc := 0; pc < len(filter); pc++ {
+		insn := filter[pc]
+		switch insn.Code {
+		case unix.BPF_LD | unix.BPF_W | unix.BPF_ABS:
+			acc = binary.LittleEndian.Uint32(data[insn.K:])
+		case unix.BPF_ALU | unix.BPF_AND | unix.BPF_K:
+			acc &= insn.K
+		case unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K:
+			pc += int(pick(acc == insn.K, insn.Jt, insn.Jf))
+		case unix.BPF_JMP | unix.BPF_JGT | unix.BPF_K:
+			pc += int(pick(acc > insn.K, insn.Jt, insn.Jf))
+		case unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K:
+			pc += int(pick(acc >= insn.K, insn.Jt, insn.Jf))
+		case unix.BPF_RET | unix.BPF_K:
+			return insn.K
+		default:
+			t.Fatalf("unexpected instruction %#v", insn)
+		}
+	}
+	t.Fatal("filter fell off the end")
+	return 0
+}
+
+func pick(cond bool, jt, jf uint8) uint8 {
+	if cond {
+		return jt
+	}
+	return jf
+}
+
+func TestDefaultProfile(t *testing.T) {
+	filter, err := Compile(DefaultProfile(), []string{"CAP_CHOWN"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	eperm := uint32(retErrno | uint32(syscall.EPERM))
+	if ret := runFilter(t, filter, nativeArch, syscallTable["kexec_load"]); ret != eperm {
+		t.Fatalf("kexec_load should be blocked, got %#x", ret)
+	}
+	if ret := runFilter(t, filter, nativeArch, syscallTable["read"]); ret != retAllow {
+		t.Fatalf("read should be allowed, got %#x", ret)
+	}
+	if x32SyscallBit != 0 {
+		if ret := runFilter(t, filter, nativeArch, syscallTable["read"]|x32SyscallBit); ret != eperm {
+			t.Fatalf("x32 syscalls should be blocked, got %#x", ret)
+		}
+	}
+	if ret := runFilter(t, filter, 0x40000003, syscallTable["read"]); ret != retKillProcess {
+		t.Fatalf("foreign arch should be killed, got %#x", ret)
+	}
+
+	// 拥有 CAP_SYS_ADMIN 和 CAP_SYS_PTRACE 时放行 mount 和 ptrace, 但依然拒绝 kexec_load
+	filter, err = Compile(DefaultProfile(), []string{"CAP_SYS_ADMIN", "CAP_SYS_PTRACE"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret := runFilter(t, filter, nativeArch, syscallTable["mount"]); ret != retAllow {
+		t.Fatalf("mount should be allowed with CAP_SYS_ADMIN, got %#x", ret)
+	}
+	if ret := runFilter(t, filter, nativeArch, syscallTable["ptrace"]); ret != retAllow {
+		t.Fatalf("ptrace should be allowed with CAP_SYS_PTRACE, got %#x", ret)
+	}
+	if ret := runFilter(t, filter, nativeArch, syscallTable["kexec_load"]); ret != eperm {
+		t.Fatalf("kexec_load should still be blocked, got %#x", ret)
+	}
+}
+
+func TestArgumentComparison(t *testing.T) {
+	config := &Seccomp{
+		DefaultAction: ActErrno,
+		Syscalls: []*Syscall{
+			{Name: "personality", Action: ActAllow, Args: []*Arg{{Index: 0, Value: 0xffffffff, Op: OpEqualTo}}},
+			{Name: "clone", Action: ActAllow, Args: []*Arg{{Index: 0, Value: 0x7e020000, ValueTwo: 0, Op: OpMaskedEqual}}},
+			{Name: "socket", Action: ActAllow, Args: []*Arg{{Index: 0, Value: 40, Op: OpNotEqual}}},
+			{Name: "dup2", Action: ActAllow, Args: []*Arg{{Index: 1, Value: 1 << 32, Op: OpGreaterEqual}}},
+			{Name: "dup3", Action: ActAllow, Args: []*Arg{{Index: 1, Value: 10, Op: OpLessThan}}},
+			{Name: "write", Action: ActAllow},
+		},
+	}
+	filter, err := Compile(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eperm := uint32(retErrno | uint32(syscall.EPERM))
+	cases := []struct {
+		name string
+		args []uint64
+		want uint32
+	}{
+		{"personality", []uint64{0xffffffff}, retAllow},
+		{"personality", []uint64{0x1ffffffff}, eperm},
+		{"personality", []uint64{8}, eperm},
+		{"clone", []uint64{0x11}, retAllow},
+		{"clone", []uint64{0x10000000}, eperm},
+		{"socket", []uint64{2}, retAllow},
+		{"socket", []uint64{40}, eperm},
+		{"dup2", []uint64{0, 1 << 32}, retAllow},
+		{"dup2", []uint64{0, 1<<32 - 1}, eperm},
+		{"dup2", []uint64{0, 1<<33 + 1}, retAllow},
+		{"dup3", []uint64{0, 9}, retAllow},
+		{"dup3", []uint64{0, 10}, eperm},
+		{"dup3", []uint64{0, 1<<32 + 1}, eperm},
+		{"write", nil, retAllow},
+		{"read", nil, eperm},
+	}
+	for _, c := range cases {
+		if ret := runFilter(t, filter, nativeArch, syscallTable[c.name], c.args...); ret != c.want {
+			t.Errorf("%s(%v) got %#x want %#x", c.name, c.args, ret, c.want)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package seccomp
+
+// 默认profile中被拒绝的系统调用, 这些调用可以影响宿主机内核或者突破容器隔离
+var blockedSyscalls = []string{
+	"acct",
+	"add_key",
+	"bpf",
+	"clock_adjtime",
+	"clock_settime",
+	"create_module",
+	"delete_module",
+	"finit_module",
+	"fsconfig",
+	"fsmount",
+	"fsopen",
+	"fspick",
+	"get_kernel_syms",
+	"get_mempolicy",
+	"init_module",
+	"ioperm",
+	"iopl",
+	"kcmp",
+	"kexec_file_load",
+	"kexec_load",
+	"keyctl",
+	"lookup_dcookie",
+	"mbind",
+	"mount",
+	"mount_setattr",
+	"move_mount",
+	"move_pages",
+	"name_to_handle_at",
+	"nfsservctl",
+	"open_by_handle_at",
+	"open_tree",
+	"perf_event_open",
+	"pivot_root",
+	"process_vm_readv",
+	"process_vm_writev",
+	"ptrace",
+	"query_module",
+	"quotactl",
+	"reboot",
+	"request_key",
+	"set_mempolicy",
+	"setns",
+	"settimeofday",
+	"swapoff",
+	"swapon",
+	"_sysctl",
+	"sysfs",
+	"umount2",
+	"unshare",
+	"uselib",
+	"userfaultfd",
+	"ustat",
+	"vm86",
+	"vm86old",
+}
+
+// 默认的seccomp profile: 放行所有系统调用, 只拒绝 blockedSyscalls 中的调用并返回 EPERM
+// 容器拥有 CAP_SYS_ADMIN 等capability时放开对应的调用, 与docker默认profile的行为一致
+func DefaultProfile() *Seccomp {
+	return &Seccomp{
+		DefaultAction: ActAllow,
+		Syscalls: []*Syscall{
+			{
+				Names:  blockedSyscalls,
+				Action: ActErrno,
+				Excludes: Filter{
+					Caps: []string{"CAP_SYS_ADMIN"},
+				},
+			},
+			{
+				Names:  []string{"ptrace", "process_vm_readv", "process_vm_writev", "kcmp"},
+				Action: ActErrno,
+				Includes: Filter{
+					Caps: []string{"CAP_SYS_ADMIN"},
+				},
+				Excludes: Filter{
+					Caps: []string{"CAP_SYS_PTRACE"},
+				},
+			},
+			{
+				Names:  []string{"kexec_load", "kexec_file_load", "reboot"},
+				Action: ActErrno,
+				Includes: Filter{
+					Caps: []string{"CAP_SYS_ADMIN"},
+				},
+				Excludes: Filter{
+					Caps: []string{"CAP_SYS_BOOT"},
+				},
+			},
+			{
+				Names:  []string{"init_module", "finit_module", "delete_module", "create_module"},
+				Action: ActErrno,
+				Includes: Filter{
+					Caps: []string{"CAP_SYS_ADMIN"},
+				},
+				Excludes: Filter{
+					Caps: []string{"CAP_SYS_MODULE"},
+				},
+			},
+		},
+	}
+}
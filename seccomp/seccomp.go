@@ -0,0 +1,133 @@
+package seccomp
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// 不安装任何过滤器
+const Unconfined = "unconfined"
+
+type Action string
+
+const (
+	ActKill        Action = "SCMP_ACT_KILL"
+	ActKillProcess Action = "SCMP_ACT_KILL_PROCESS"
+	ActKillThread  Action = "SCMP_ACT_KILL_THREAD"
+	ActTrap        Action = "SCMP_ACT_TRAP"
+	ActErrno       Action = "SCMP_ACT_ERRNO"
+	ActTrace       Action = "SCMP_ACT_TRACE"
+	ActLog         Action = "SCMP_ACT_LOG"
+	ActAllow       Action = "SCMP_ACT_ALLOW"
+)
+
+type Operator string
+
+const (
+	OpNotEqual     Operator = "SCMP_CMP_NE"
+	OpLessThan     Operator = "SCMP_CMP_LT"
+	OpLessEqual    Operator = "SCMP_CMP_LE"
+	OpEqualTo      Operator = "SCMP_CMP_EQ"
+	OpGreaterEqual Operator = "SCMP_CMP_GE"
+	OpGreaterThan  Operator = "SCMP_CMP_GT"
+	OpMaskedEqual  Operator = "SCMP_CMP_MASKED_EQ"
+)
+
+// 与 docker/OCI 的 seccomp profile JSON 格式兼容的配置
+type Seccomp struct {
+	DefaultAction   Action     `json:"defaultAction"`
+	DefaultErrnoRet *uint      `json:"defaultErrnoRet,omitempty"`
+	Architectures   []string   `json:"architectures,omitempty"`
+	ArchMap         []ArchMap  `json:"archMap,omitempty"`
+	Syscalls        []*Syscall `json:"syscalls"`
+}
+
+type ArchMap struct {
+	Arch      string   `json:"architecture"`
+	SubArches []string `json:"subArchitectures"`
+}
+
+// 一条系统调用规则, 同一条规则里的所有参数条件需要同时满足
+type Syscall struct {
+	Name     string   `json:"name,omitempty"`
+	Names    []string `json:"names,omitempty"`
+	Action   Action   `json:"action"`
+	ErrnoRet *uint    `json:"errnoRet,omitempty"`
+	Args     []*Arg   `json:"args"`
+	Includes Filter   `json:"includes"`
+	Excludes Filter   `json:"excludes"`
+}
+
+type Arg struct {
+	Index    uint     `json:"index"`
+	Value    uint64   `json:"value"`
+	ValueTwo uint64   `json:"valueTwo"`
+	Op       Operator `json:"op"`
+}
+
+// 根据容器的capability和架构决定规则是否生效, docker默认profile依赖这个字段
+type Filter struct {
+	Caps   []string `json:"caps,omitempty"`
+	Arches []string `json:"arches,omitempty"`
+}
+
+// 读取并解析一个 seccomp profile 文件
+func LoadProfile(path string) (*Seccomp, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Read seccomp profile %s error %v", path, err)
+	}
+	config := &Seccomp{}
+	if err := json.Unmarshal(content, config); err != nil {
+		return nil, fmt.Errorf("Decode seccomp profile %s error %v", path, err)
+	}
+	return config, nil
+}
+
+// 编译profile并为当前线程安装seccomp过滤器
+// 安装过滤器需要 no_new_privs 或者 CAP_SYS_ADMIN, 调用方需要保证在exec之前且在同一个线程上调用
+func InitSeccomp(config *Seccomp, caps []string) error {
+	if config == nil {
+		return nil
+	}
+	filter, err := Compile(config, caps)
+	if err != nil {
+		return err
+	}
+	prog := unix.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: &filter[0],
+	}
+	if err := unix.Prctl(unix.PR_SET_SECCOMP, unix.SECCOMP_MODE_FILTER, uintptr(unsafe.Pointer(&prog)), 0, 0); err != nil {
+		return fmt.Errorf("Install seccomp filter error %v", err)
+	}
+	return nil
+}
+
+// 当前架构是否有系统调用表, 没有时无法编译过滤器
+func Supported() bool {
+	return nativeArch != 0
+}
+
+// 把编译好的过滤器写入w, 交给不能使用Go代码的进程安装, 例如 paddle exec 的nsenter
+// 格式为指令数(uint32)加上 struct sock_filter 数组, config为nil时只写入指令数0
+// 能编译出过滤器的x86_64和arm64都是小端序, 按小端序写入即可与C中的结构体一致
+func WriteFilter(w io.Writer, config *Seccomp, caps []string) error {
+	var filter []unix.SockFilter
+	if config != nil {
+		var err error
+		if filter, err = Compile(config, caps); err != nil {
+			return err
+		}
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(filter))); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.LittleEndian, filter)
+}
@@ -0,0 +1,12 @@
+//go:build linux && !amd64 && !arm64
+// +build linux,!amd64,!arm64
+
+package seccomp
+
+// 目前只提供了 x86_64 和 arm64 的系统调用表, 其它架构上编译过滤器会直接报错
+// 默认profile在这些架构上不安装过滤器, 见 Supported
+const nativeArch = 0
+
+const x32SyscallBit = 0
+
+var syscallTable = map[string]int{}
@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// 复制目录树的方式
+type copyMode int
+
+const (
+	// 复制每个文件的内容, 文件系统支持时使用reflink共享数据块
+	copyContent copyMode = iota
+	// 文件直接硬链接到源文件, 只能用于之后不会被原地修改的只读层
+	copyHardlink
+)
+
+// linux/fs.h 中的 FICLONE, 让目标文件与源文件共享数据块, 写入时再复制
+const ficlone = 0x40049409
+
+// 复制时转换文件的属主, 例如 user namespace 下把容器内的id平移到宿主机上映射之后的id
+type OwnerFunc func(uid, gid int) (int, int, error)
+
+// 复制src目录树的内容到dst, 用owner转换每个文件的属主, 文件系统支持时使用reflink共享数据块
+func CopyTree(src, dst string, owner OwnerFunc) error {
+	return copyTree(src, dst, copyContent, owner)
+}
+
+// 把src目录树复制到dst, 保留属主、权限、时间戳、扩展属性和硬链接关系, owner不为nil时用它转换属主
+// 硬链接失败(例如跨文件系统)时退回到复制内容
+func copyTree(src, dst string, mode copyMode, owner OwnerFunc) error {
+	// 源目录树中同一个inode第一次被复制到的位置, 之后的硬链接都指向它
+	links := make(map[uint64]string)
+	var dirs []string
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		stat := info.Sys().(*syscall.Stat_t)
+
+		switch {
+		case info.IsDir():
+			if err := os.Mkdir(target, info.Mode().Perm()); err != nil && !os.IsExist(err) {
+				return err
+			}
+			// 目录的时间戳在其中的文件复制完成之后再设置
+			dirs = append(dirs, path)
+		case info.Mode().IsRegular():
+			if mode == copyHardlink {
+				if err := os.Link(path, target); err == nil {
+					return nil
+				}
+			}
+			if first, ok := links[stat.Ino]; ok && stat.Nlink > 1 {
+				return os.Link(first, target)
+			}
+			if err := copyFile(path, target, info); err != nil {
+				return err
+			}
+			links[stat.Ino] = target
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+		case info.Mode()&(os.ModeDevice|os.ModeNamedPipe) != 0:
+			if err := unix.Mknod(target, stat.Mode, int(stat.Rdev)); err != nil {
+				return err
+			}
+		default:
+			// socket之类的文件不需要复制
+			return nil
+		}
+		return copyMetadata(path, target, info, owner)
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		rel, _ := filepath.Rel(src, dirs[i])
+		info, err := os.Lstat(dirs[i])
+		if err != nil {
+			return err
+		}
+		if err := copyTimes(filepath.Join(dst, rel), info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(src, dst string, info os.FileInfo) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, out.Fd(), ficlone, in.Fd()); errno == 0 {
+		return nil
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		return fmt.Errorf("Copy %s error %v", src, err)
+	}
+	return nil
+}
+
+// 属主要在权限之前设置, chown 会清掉 setuid/setgid 位
+func copyMetadata(src, dst string, info os.FileInfo, owner OwnerFunc) error {
+	stat := info.Sys().(*syscall.Stat_t)
+	uid, gid := int(stat.Uid), int(stat.Gid)
+	if owner != nil {
+		var err error
+		if uid, gid, err = owner(uid, gid); err != nil {
+			return fmt.Errorf("%s: %v", src, err)
+		}
+	}
+	if err := os.Lchown(dst, uid, gid); err != nil {
+		return err
+	}
+	if err := copyXattrs(src, dst); err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return copyTimes(dst, info)
+	}
+	if err := os.Chmod(dst, info.Mode()); err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return nil
+	}
+	return copyTimes(dst, info)
+}
+
+func copyTimes(dst string, info os.FileInfo) error {
+	stat := info.Sys().(*syscall.Stat_t)
+	ts := []unix.Timespec{
+		unix.NsecToTimespec(syscall.TimespecToNsec(stat.Atim)),
+		unix.NsecToTimespec(syscall.TimespecToNsec(stat.Mtim)),
+	}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, dst, ts, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// 复制扩展属性, 例如文件的 security.capability, 文件系统不支持时忽略
+func copyXattrs(src, dst string) error {
+	size, err := unix.Llistxattr(src, nil)
+	if err != nil || size == 0 {
+		return nil
+	}
+	buf := make([]byte, size)
+	if size, err = unix.Llistxattr(src, buf); err != nil {
+		return nil
+	}
+	start := 0
+	for i := 0; i < size; i++ {
+		if buf[i] != 0 {
+			continue
+		}
+		name := string(buf[start:i])
+		start = i + 1
+		value, err := getXattr(src, name)
+		if err != nil {
+			return err
+		}
+		if err := unix.Lsetxattr(dst, name, value, 0); err != nil && err != unix.ENOTSUP {
+			return fmt.Errorf("Set xattr %s on %s error %v", name, dst, err)
+		}
+	}
+	return nil
+}
+
+func getXattr(path, name string) ([]byte, error) {
+	size, err := unix.Lgetxattr(path, name, nil)
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, size)
+	size, err = unix.Lgetxattr(path, name, value)
+	if err != nil {
+		return nil, err
+	}
+	return value[:size], nil
+}
@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"github.com/IsolationWyn/paddle/archive"
+)
+
+// 各个存储驱动保存层的根目录, 每个驱动使用其下以驱动名命名的子目录
+var StorageRoot string = "/root/storage"
+
+// 容器rootfs的存储驱动, 负责镜像层和容器可写层的创建、挂载和删除
+// 层由id标识, 除基础层以外每个层都有一个父层, 挂载一个层时它的所有父层都会一起出现在rootfs中
+type Driver interface {
+	// 驱动名, 即 --storage-driver 的取值
+	Name() string
+	// 创建一个只读层, 例如镜像层, parent 为空时创建基础层
+	// 只读层的内容在创建之后只能整个替换文件, 不能原地修改, 驱动可能让它与父层共享文件
+	Create(id, parent string) error
+	// 创建容器的可写层
+	CreateReadWrite(id, parent string) error
+	// 删除一个层, 调用者需要保证没有其它层以它为父层
+	Remove(id string) error
+	// 修改层的id, 调用者需要保证没有其它层以它为父层, 用于把解压完成的临时层换成正式的id
+	Rename(id, newID string) error
+	// 层是否已经存在
+	Exists(id string) bool
+	// 层自身内容所在的目录, 基础层创建之后把镜像解压到这里
+	Dir(id string) string
+	// 把OCI格式的层tar包解压到新创建的层中, 并按驱动的方式处理其中的whiteout, r 可以是gzip压缩的
+	ApplyDiff(id string, r io.Reader) error
+	// 把层和它的所有父层挂载到target, 得到容器的rootfs
+	Mount(id, target string) error
+	// 卸载 Mount 挂载的rootfs
+	Unmount(target string) error
+	// 层相对于父层的变化
+	Diff(id string) ([]Change, error)
+	// 层自身占用的磁盘空间, 不包括父层
+	Usage(id string) (int64, error)
+}
+
+// 驱动的构造函数和检测宿主机是否支持的函数, 参数都是驱动自己的根目录
+type driverInit struct {
+	init      func(root string) Driver
+	supported func(root string) bool
+}
+
+var drivers = map[string]driverInit{}
+
+// 自动检测时的优先级, vfs 总是可用, 放在最后
+var priority = []string{overlayName, vfsName}
+
+func register(name string, init func(root string) Driver, supported func(root string) bool) {
+	drivers[name] = driverInit{init: init, supported: supported}
+}
+
+// 根据驱动名创建驱动, 名字为空时按优先级选择第一个宿主机支持的驱动
+func New(name string) (Driver, error) {
+	if name == "" {
+		for _, candidate := range priority {
+			d := drivers[candidate]
+			if root := filepath.Join(StorageRoot, candidate); d.supported(root) {
+				return d.init(root), nil
+			}
+		}
+		return nil, fmt.Errorf("No supported storage driver found")
+	}
+	d, ok := drivers[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown storage driver %s", name)
+	}
+	root := filepath.Join(StorageRoot, name)
+	if !d.supported(root) {
+		return nil, fmt.Errorf("Storage driver %s is not supported on this host", name)
+	}
+	return d.init(root), nil
+}
+
+// 变化的类型, 输出格式与 docker diff 相同
+type ChangeKind int
+
+const (
+	ChangeModify ChangeKind = iota
+	ChangeAdd
+	ChangeDelete
+	// 目录被删除之后重新创建, 父层中目录下原有的内容都被删除, 打包时写成 .wh..wh..opq
+	ChangeOpaque
+)
+
+// 层中一个路径的变化, Path 是rootfs中以 / 开头的路径
+type Change struct {
+	Path string
+	Kind ChangeKind
+}
+
+// ChangeOpaque 和 docker diff 一样显示为目录的修改
+func (c Change) String() string {
+	kind := "C"
+	switch c.Kind {
+	case ChangeAdd:
+		kind = "A"
+	case ChangeDelete:
+		kind = "D"
+	}
+	return kind + " " + c.Path
+}
+
+func sortChanges(changes []Change) {
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+}
+
+// 目录树占用的磁盘块大小, 硬链接只计算一次
+func directoryUsage(root string) (int64, error) {
+	var size int64
+	seen := make(map[uint64]bool)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return nil
+		}
+		if stat.Nlink > 1 {
+			if seen[stat.Ino] {
+				return nil
+			}
+			seen[stat.Ino] = true
+		}
+		size += stat.Blocks * 512
+		return nil
+	})
+	return size, err
+}
+
+// 把层tar包解压到层的目录中, whiteout按驱动的格式转换
+func applyLayer(dir string, r io.Reader, format archive.WhiteoutFormat) error {
+	return archive.Untar(r, dir, &archive.TarOptions{WhiteoutFormat: format})
+}
+
+// 层的所有内容都在 <root>/<id> 下, 改名即可
+func renameLayer(root, id, newID string) error {
+	if err := os.Rename(filepath.Join(root, id), filepath.Join(root, newID)); err != nil {
+		return fmt.Errorf("Rename layer %s to %s error %v", id, newID, err)
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/IsolationWyn/paddle/archive"
+	"golang.org/x/sys/unix"
+)
+
+const overlayName = "overlay2"
+
+// 宿主机的文件系统本身是overlay时不能再作为upperdir
+const overlayfsMagic = 0x794c7630
+
+func init() {
+	register(overlayName, func(root string) Driver { return &OverlayDriver{root: root} }, overlaySupported)
+}
+
+// overlay2 驱动, 每个层保存在 <root>/<id> 下:
+// diff 是层自身的内容, 挂载时作为upperdir或lowerdir
+// work 是overlay要求的与upperdir在同一文件系统上的工作目录
+// parent 记录父层的id, 基础层没有这个文件
+type OverlayDriver struct {
+	root string
+}
+
+func (d *OverlayDriver) Name() string {
+	return overlayName
+}
+
+func (d *OverlayDriver) layerDir(id string) string {
+	return filepath.Join(d.root, id)
+}
+
+func (d *OverlayDriver) Dir(id string) string {
+	return filepath.Join(d.layerDir(id), "diff")
+}
+
+func (d *OverlayDriver) Exists(id string) bool {
+	_, err := os.Stat(d.Dir(id))
+	return err == nil
+}
+
+func (d *OverlayDriver) Create(id, parent string) error {
+	if parent != "" && !d.Exists(parent) {
+		return fmt.Errorf("Parent layer %s of %s does not exist", parent, id)
+	}
+	dir := d.layerDir(id)
+	if err := os.MkdirAll(d.Dir(id), 0755); err != nil {
+		return fmt.Errorf("Mkdir layer %s error %v", id, err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "work"), 0700); err != nil {
+		os.RemoveAll(dir)
+		return fmt.Errorf("Mkdir work dir of %s error %v", id, err)
+	}
+	if parent != "" {
+		if err := ioutil.WriteFile(filepath.Join(dir, "parent"), []byte(parent), 0644); err != nil {
+			os.RemoveAll(dir)
+			return fmt.Errorf("Write parent of %s error %v", id, err)
+		}
+	}
+	return nil
+}
+
+// 解压时把OCI的whiteout转换成overlay的格式:
+// .wh.<name> 换成同名的 0/0 字符设备, 同一层中已经有<name>时不需要
+// .wh..wh..opq 换成目录上的 trusted.overlay.opaque 属性
+func (d *OverlayDriver) ApplyDiff(id string, r io.Reader) error {
+	return applyLayer(d.Dir(id), r, archive.OverlayWhiteoutFormat)
+}
+
+// overlay的每个层都只保存自身的内容, 只读层和可写层没有区别
+func (d *OverlayDriver) CreateReadWrite(id, parent string) error {
+	return d.Create(id, parent)
+}
+
+func (d *OverlayDriver) Remove(id string) error {
+	return os.RemoveAll(d.layerDir(id))
+}
+
+func (d *OverlayDriver) Rename(id, newID string) error {
+	return renameLayer(d.root, id, newID)
+}
+
+// 从父层开始到基础层的所有层的diff目录, 即挂载时的lowerdir, 越靠前的层越在上面
+func (d *OverlayDriver) lowers(id string) ([]string, error) {
+	var lowers []string
+	for {
+		content, err := ioutil.ReadFile(filepath.Join(d.layerDir(id), "parent"))
+		if os.IsNotExist(err) {
+			return lowers, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		id = string(content)
+		lowers = append(lowers, d.Dir(id))
+	}
+}
+
+func (d *OverlayDriver) Mount(id, target string) error {
+	lowers, err := d.lowers(id)
+	if err != nil {
+		return fmt.Errorf("Read parents of layer %s error %v", id, err)
+	}
+	// 基础层没有lowerdir, 直接bind过去
+	if len(lowers) == 0 {
+		return unix.Mount(d.Dir(id), target, "", unix.MS_BIND, "")
+	}
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s",
+		strings.Join(lowers, ":"), d.Dir(id), filepath.Join(d.layerDir(id), "work"))
+	// 挂载参数不能超过一个内存页
+	if len(options) >= unix.Getpagesize() {
+		return fmt.Errorf("Layer %s has too many parents to mount", id)
+	}
+	if err := unix.Mount("overlay", target, "overlay", 0, options); err != nil {
+		return fmt.Errorf("Mount overlay on %s error %v", target, err)
+	}
+	return nil
+}
+
+func (d *OverlayDriver) Unmount(target string) error {
+	return unix.Unmount(target, 0)
+}
+
+// upperdir中的每个路径都是一个变化:
+// 删除的文件是设备号为0/0的字符设备(whiteout), 父层中已有的路径是修改, 其余是新增
+// 被删除之后重新创建的目录带有 trusted.overlay.opaque 属性, 父层中有这个目录时报告为 ChangeOpaque, 目录下的路径都是新增
+func (d *OverlayDriver) Diff(id string) ([]Change, error) {
+	lowers, err := d.lowers(id)
+	if err != nil {
+		return nil, err
+	}
+	upper := d.Dir(id)
+	var changes []Change
+	err = filepath.Walk(upper, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == upper {
+			return nil
+		}
+		rel := "/" + strings.TrimPrefix(path, upper+"/")
+		change := Change{Path: rel, Kind: ChangeAdd}
+		if isWhiteout(info) {
+			change.Kind = ChangeDelete
+		} else if existsInLowers(upper, lowers, rel) {
+			change.Kind = ChangeModify
+			if info.IsDir() && isOpaque(path) {
+				change.Kind = ChangeOpaque
+			}
+		}
+		changes = append(changes, change)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortChanges(changes)
+	return changes, nil
+}
+
+func (d *OverlayDriver) Usage(id string) (int64, error) {
+	return directoryUsage(d.Dir(id))
+}
+
+func isWhiteout(info os.FileInfo) bool {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && info.Mode()&os.ModeCharDevice != 0 && stat.Rdev == 0
+}
+
+// 路径在父层合并之后的视图中是否存在
+// 上层的whiteout会遮住下层的同名路径, opaque目录会遮住下层中这个目录下的所有内容, upperdir中的opaque目录同样如此
+func existsInLowers(upper string, lowers []string, rel string) bool {
+	if hidesLowers(upper, rel) {
+		return false
+	}
+	for _, lower := range lowers {
+		if info, err := os.Lstat(filepath.Join(lower, rel)); err == nil {
+			return !isWhiteout(info)
+		}
+		if hidesLowers(lower, rel) {
+			return false
+		}
+	}
+	return false
+}
+
+// 层中rel的某一级上级目录是opaque目录或者whiteout时, 更下面的层中的rel不可见
+func hidesLowers(layer, rel string) bool {
+	for dir := filepath.Dir(rel); dir != "/"; dir = filepath.Dir(dir) {
+		info, err := os.Lstat(filepath.Join(layer, dir))
+		if err != nil {
+			continue
+		}
+		if isWhiteout(info) || (info.IsDir() && isOpaque(filepath.Join(layer, dir))) {
+			return true
+		}
+	}
+	return false
+}
+
+func isOpaque(dir string) bool {
+	value := make([]byte, 1)
+	n, err := unix.Lgetxattr(dir, "trusted.overlay.opaque", value)
+	return err == nil && n == 1 && value[0] == 'y'
+}
+
+// 内核支持overlay, 并且根目录所在的文件系统可以作为upperdir
+func overlaySupported(root string) bool {
+	f, err := os.Open("/proc/filesystems")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	found := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if strings.HasSuffix(scanner.Text(), "\toverlay") {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return false
+	}
+	// 根目录可能还没有创建, 检查最近的已存在的上级目录
+	for dir := root; ; dir = filepath.Dir(dir) {
+		var st unix.Statfs_t
+		if err := unix.Statfs(dir, &st); err == nil {
+			return st.Type != overlayfsMagic
+		}
+		if dir == "/" {
+			return false
+		}
+	}
+}
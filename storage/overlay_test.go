@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestOverlayDiff(t *testing.T) {
+	root, err := ioutil.TempDir("", "paddle-overlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	d := &OverlayDriver{root: root}
+	if err := d.Create("image", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateReadWrite("container", "image"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Create("orphan", "missing"); err == nil {
+		t.Fatal("expected error for missing parent")
+	}
+
+	os.MkdirAll(filepath.Join(d.Dir("image"), "etc"), 0755)
+	ioutil.WriteFile(filepath.Join(d.Dir("image"), "etc/hosts"), nil, 0644)
+	ioutil.WriteFile(filepath.Join(d.Dir("image"), "etc/passwd"), nil, 0644)
+
+	upper := d.Dir("container")
+	os.MkdirAll(filepath.Join(upper, "etc"), 0755)
+	ioutil.WriteFile(filepath.Join(upper, "etc/hosts"), []byte("127.0.0.1"), 0644)
+	ioutil.WriteFile(filepath.Join(upper, "new"), nil, 0644)
+	// 删除的文件在upperdir中是一个 0/0 的字符设备
+	if err := syscall.Mknod(filepath.Join(upper, "etc/passwd"), syscall.S_IFCHR, 0); err != nil {
+		t.Skipf("mknod whiteout: %v", err)
+	}
+
+	changes, err := d.Diff("container")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Change{
+		{Path: "/etc", Kind: ChangeModify},
+		{Path: "/etc/hosts", Kind: ChangeModify},
+		{Path: "/etc/passwd", Kind: ChangeDelete},
+		{Path: "/new", Kind: ChangeAdd},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Fatalf("expected %v, got %v", expected, changes)
+	}
+}
+
+func TestOverlayDiffOpaque(t *testing.T) {
+	root, err := ioutil.TempDir("", "paddle-overlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if !overlaySupported(root) {
+		t.Skip("overlay not supported")
+	}
+	d := &OverlayDriver{root: root}
+	d.Create("image", "")
+	os.MkdirAll(filepath.Join(d.Dir("image"), "dir/sub"), 0755)
+	ioutil.WriteFile(filepath.Join(d.Dir("image"), "dir/old"), nil, 0644)
+	// 中间层把 /other 整体替换, 基础层中的 /other/old 不再可见
+	d.Create("layer", "image")
+	os.MkdirAll(filepath.Join(d.Dir("image"), "other"), 0755)
+	ioutil.WriteFile(filepath.Join(d.Dir("image"), "other/old"), nil, 0644)
+	os.MkdirAll(filepath.Join(d.Dir("layer"), "other"), 0755)
+	if err := unix.Setxattr(filepath.Join(d.Dir("layer"), "other"), "trusted.overlay.opaque", []byte("y"), 0); err != nil {
+		t.Skipf("set trusted xattr: %v", err)
+	}
+	d.CreateReadWrite("container", "layer")
+
+	// 在容器中删除目录之后重新创建
+	mnt := filepath.Join(root, "mnt")
+	os.Mkdir(mnt, 0755)
+	if err := d.Mount("container", mnt); err != nil {
+		t.Skipf("mount overlay: %v", err)
+	}
+	os.RemoveAll(filepath.Join(mnt, "dir"))
+	os.Mkdir(filepath.Join(mnt, "dir"), 0755)
+	ioutil.WriteFile(filepath.Join(mnt, "dir/new"), nil, 0644)
+	ioutil.WriteFile(filepath.Join(mnt, "other/old"), nil, 0644)
+	if err := d.Unmount(mnt); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := d.Diff("container")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Change{
+		{Path: "/dir", Kind: ChangeOpaque},
+		{Path: "/dir/new", Kind: ChangeAdd},
+		{Path: "/other", Kind: ChangeModify},
+		{Path: "/other/old", Kind: ChangeAdd},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Fatalf("expected %v, got %v", expected, changes)
+	}
+}
@@ -0,0 +1,204 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/IsolationWyn/paddle/archive"
+	"golang.org/x/sys/unix"
+)
+
+const vfsName = "vfs"
+
+func init() {
+	register(vfsName, func(root string) Driver { return &VfsDriver{root: root} }, func(string) bool { return true })
+}
+
+// vfs 驱动不依赖任何联合文件系统, 每个层都是父层的一份完整拷贝, 可以在嵌套容器等没有overlay的环境中使用
+// 层保存在 <root>/<id>/diff, parent 文件记录父层的id, 只用于 Diff
+// 只读层与父层共享文件的硬链接, 可写层复制文件内容, 文件系统支持时共享数据块
+type VfsDriver struct {
+	root string
+}
+
+func (d *VfsDriver) Name() string {
+	return vfsName
+}
+
+func (d *VfsDriver) layerDir(id string) string {
+	return filepath.Join(d.root, id)
+}
+
+func (d *VfsDriver) Dir(id string) string {
+	return filepath.Join(d.layerDir(id), "diff")
+}
+
+func (d *VfsDriver) Exists(id string) bool {
+	_, err := os.Stat(d.Dir(id))
+	return err == nil
+}
+
+func (d *VfsDriver) Create(id, parent string) error {
+	return d.create(id, parent, copyHardlink)
+}
+
+func (d *VfsDriver) CreateReadWrite(id, parent string) error {
+	return d.create(id, parent, copyContent)
+}
+
+func (d *VfsDriver) create(id, parent string, mode copyMode) error {
+	if parent != "" && !d.Exists(parent) {
+		return fmt.Errorf("Parent layer %s of %s does not exist", parent, id)
+	}
+	dir := d.layerDir(id)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("Mkdir layer %s error %v", id, err)
+	}
+	if parent == "" {
+		if err := os.Mkdir(d.Dir(id), 0755); err != nil && !os.IsExist(err) {
+			return fmt.Errorf("Mkdir layer %s error %v", id, err)
+		}
+		return nil
+	}
+	// 之前失败留下的拷贝先删掉, 否则复制时会与已有文件冲突
+	os.RemoveAll(d.Dir(id))
+	if err := copyTree(d.Dir(parent), d.Dir(id), mode, nil); err != nil {
+		os.RemoveAll(dir)
+		return fmt.Errorf("Copy layer %s to %s error %v", parent, id, err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "parent"), []byte(parent), 0644); err != nil {
+		os.RemoveAll(dir)
+		return fmt.Errorf("Write parent of %s error %v", id, err)
+	}
+	return nil
+}
+
+// 层中已经是父层的完整拷贝, 被whiteout的路径在解压时直接删除, 本层中新建的同名文件不受影响
+func (d *VfsDriver) ApplyDiff(id string, r io.Reader) error {
+	return applyLayer(d.Dir(id), r, archive.ApplyWhiteoutFormat)
+}
+
+func (d *VfsDriver) Remove(id string) error {
+	return os.RemoveAll(d.layerDir(id))
+}
+
+func (d *VfsDriver) Rename(id, newID string) error {
+	return renameLayer(d.root, id, newID)
+}
+
+// 层本身就是完整的rootfs, bind过去即可
+func (d *VfsDriver) Mount(id, target string) error {
+	if err := unix.Mount(d.Dir(id), target, "", unix.MS_BIND, ""); err != nil {
+		return fmt.Errorf("Bind layer %s to %s error %v", id, target, err)
+	}
+	return nil
+}
+
+func (d *VfsDriver) Unmount(target string) error {
+	return unix.Unmount(target, 0)
+}
+
+func (d *VfsDriver) parent(id string) (string, error) {
+	content, err := ioutil.ReadFile(filepath.Join(d.layerDir(id), "parent"))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return string(content), err
+}
+
+// 逐个比较层和父层中的文件: 只在层中存在的是新增, 属性不同的是修改, 只在父层中存在的是删除
+// 与父层共享同一个inode的文件没有变化; 复制时保留了时间戳, 所以修改时间不同说明文件被改过
+func (d *VfsDriver) Diff(id string) ([]Change, error) {
+	parent, err := d.parent(id)
+	if err != nil {
+		return nil, err
+	}
+	layer := d.Dir(id)
+	lower := ""
+	if parent != "" {
+		lower = d.Dir(parent)
+	}
+	var changes []Change
+	err = filepath.Walk(layer, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == layer {
+			return nil
+		}
+		rel := strings.TrimPrefix(path, layer)
+		if lower == "" {
+			changes = append(changes, Change{Path: rel, Kind: ChangeAdd})
+			return nil
+		}
+		lowerInfo, err := os.Lstat(filepath.Join(lower, rel))
+		if err != nil {
+			changes = append(changes, Change{Path: rel, Kind: ChangeAdd})
+			return nil
+		}
+		if fileChanged(info, lowerInfo, filepath.Join(lower, rel), path) {
+			changes = append(changes, Change{Path: rel, Kind: ChangeModify})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if lower != "" {
+		err = filepath.Walk(lower, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel := strings.TrimPrefix(path, lower)
+			if rel == "" {
+				return nil
+			}
+			if _, err := os.Lstat(filepath.Join(layer, rel)); os.IsNotExist(err) {
+				changes = append(changes, Change{Path: rel, Kind: ChangeDelete})
+				// 删除的目录只报告目录本身
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sortChanges(changes)
+	return changes, nil
+}
+
+func (d *VfsDriver) Usage(id string) (int64, error) {
+	return directoryUsage(d.Dir(id))
+}
+
+func fileChanged(info, lowerInfo os.FileInfo, lowerPath, path string) bool {
+	stat := info.Sys().(*syscall.Stat_t)
+	lowerStat := lowerInfo.Sys().(*syscall.Stat_t)
+	if stat.Ino == lowerStat.Ino && stat.Dev == lowerStat.Dev {
+		return false
+	}
+	if info.Mode() != lowerInfo.Mode() || stat.Uid != lowerStat.Uid || stat.Gid != lowerStat.Gid ||
+		stat.Rdev != lowerStat.Rdev || stat.Mtim != lowerStat.Mtim {
+		return true
+	}
+	if info.IsDir() {
+		return false
+	}
+	if info.Size() != lowerInfo.Size() {
+		return true
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		link, _ := os.Readlink(path)
+		lowerLink, _ := os.Readlink(lowerPath)
+		return link != lowerLink
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestVfsLayers(t *testing.T) {
+	root, err := ioutil.TempDir("", "paddle-vfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	d := &VfsDriver{root: root}
+	if err := d.Create("image", ""); err != nil {
+		t.Fatal(err)
+	}
+	base := d.Dir("image")
+	os.MkdirAll(filepath.Join(base, "etc"), 0755)
+	ioutil.WriteFile(filepath.Join(base, "etc/hosts"), []byte("127.0.0.1"), 0644)
+	ioutil.WriteFile(filepath.Join(base, "etc/passwd"), nil, 0644)
+	os.Link(filepath.Join(base, "etc/passwd"), filepath.Join(base, "etc/passwd-"))
+	os.Symlink("hosts", filepath.Join(base, "etc/hosts.link"))
+
+	// 只读层与父层共享inode, 可写层是独立的拷贝, 但保留源目录树中的硬链接
+	if err := d.Create("readonly", "image"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CreateReadWrite("container", "image"); err != nil {
+		t.Fatal(err)
+	}
+	inode := func(path string) uint64 {
+		info, err := os.Lstat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Sys().(*syscall.Stat_t).Ino
+	}
+	if inode(filepath.Join(d.Dir("readonly"), "etc/hosts")) != inode(filepath.Join(base, "etc/hosts")) {
+		t.Fatal("expected readonly layer to share files with its parent")
+	}
+	layer := d.Dir("container")
+	if inode(filepath.Join(layer, "etc/hosts")) == inode(filepath.Join(base, "etc/hosts")) {
+		t.Fatal("expected read-write layer to copy files")
+	}
+	if inode(filepath.Join(layer, "etc/passwd")) != inode(filepath.Join(layer, "etc/passwd-")) {
+		t.Fatal("expected hardlinks to be preserved")
+	}
+
+	if changes, err := d.Diff("container"); err != nil || len(changes) != 0 {
+		t.Fatalf("expected no changes in a fresh copy, got %v %v", changes, err)
+	}
+	ioutil.WriteFile(filepath.Join(layer, "etc/hosts"), []byte("10.0.0.2"), 0644)
+	os.Remove(filepath.Join(layer, "etc/passwd"))
+	ioutil.WriteFile(filepath.Join(layer, "new"), nil, 0644)
+
+	changes, err := d.Diff("container")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Change{
+		{Path: "/etc", Kind: ChangeModify},
+		{Path: "/etc/hosts", Kind: ChangeModify},
+		{Path: "/etc/passwd", Kind: ChangeDelete},
+		{Path: "/new", Kind: ChangeAdd},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Fatalf("expected %v, got %v", expected, changes)
+	}
+}